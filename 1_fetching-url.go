@@ -4,109 +4,4481 @@
 	并发、顺序：concurrent <-> sequential		（时间段内是否同时进行）
 	异步、同步：asynchronous <-> synchronous	（函数执行是否立即返回）
 	并行、串行：parallel <-> serial			（时间点上是否同时进行）(多核硬件支持)
+
+	go run 1_fetching-url.go [-mode sequential|concurrent|both] [-workers N] [-per-host N] [-timeout D] [-deadline D] url1 url2 ...
+	go run 1_fetching-url.go [flags] -i urls.txt
+	go run 1_fetching-url.go report [-history file] [url ...]
+	cat urls.txt | go run 1_fetching-url.go [flags]
+
+	-mode		run the sequential fetcher, the concurrent one, or both (the default), one after the other
+	-i		read the urls from a file ("-" = stdin; stdin is also the default when no url is given):
+			one url per line, blank lines and # comments skipped, duplicates (after normalization) dropped;
+			the list is streamed, not loaded, and each result keeps its line number
+	-workers	upper bound on fetches running at the same time (the size of the worker pool)
+	-per-host	upper bound on fetches running at the same time against ONE host (0 = no limit)
+	-timeout	time limit for ONE url: all its attempts, the delays between them, and its body (0 = no limit);
+			with -o, a body being saved may take longer, as long as no -timeout passes without a byte of it
+	-deadline	time limit for the WHOLE run (0 = no limit)
+	-attempts	maximum number of attempts per url (1 = never retry)
+	-backoff	delay before the 1st retry; it doubles on every further retry (plus random jitter)
+	-max-backoff	upper bound on a single delay between retries
+	-format		text (default), json (JSON Lines, one object per url) or csv; each record names its mode (sequential / concurrent)
+	-https		use https:// for bare hosts (and upgrade http:// urls) instead of http://
+	-o		save every 2xx body into this directory, and list them in dir/manifest.json
+			(url -> path, size, SHA-256); the file name comes from Content-Disposition or the url path,
+			with -1, -2 ... appended on a clash; files are written under a temporary name, then renamed.
+			A url keeps the file it got in an earlier run (the manifest.json already in dir says which),
+			which is replaced; with -mode both, the body of the 2nd pass is counted but not saved again
+	-resume		with -o: a download cut short (failure, Ctrl-C, -deadline) is kept as dir/.fetch-<key>.part,
+			and the next run with -resume asks only for the missing bytes (Range + If-Range);
+			the part is thrown away if the ETag / Last-Modified or Content-Length no longer match
+	-chunks		with -o: split a body of at least 2 MiB into up to N Range requests running in parallel,
+			if the server sends "Accept-Ranges: bytes", a Content-Length and an ETag / Last-Modified
+	-progress	with -o: a live progress bar per download on stderr (size, percentage, speed)
+	-cache		keep each 200 body with its ETag / Last-Modified in this directory; later runs send
+			If-None-Match / If-Modified-Since, and a "304 cached" answer is served from disk
+	-bench		benchmark mode: fetch every url N times, first with 1 worker, then with -workers;
+			each pass reports p50 / p90 / p99 / max latency, throughput, error rate (failures and 4xx / 5xx)
+			and a latency histogram, followed by the sequential / concurrent speedup;
+			-per-host doesn't apply, so -workers is the concurrency even against a single host
+	-crawl		crawl mode: parse every HTML page for <a href> links and follow them, breadth-first,
+			without leaving the starting hosts and visiting every url once; prints the site graph
+			(each page with its status and the same-host pages it links to)
+	-depth		crawl mode: how many links away from the starting urls to go (0 = the starting urls only)
+	-check		link-check mode: fetch the given pages, then every href / src target on them
+			(HEAD first, GET if HEAD fails); every broken link (failed fetch, 4xx / 5xx) is reported
+			as "page:line: <tag attr="link"> problem", and the exit status is 1 if there was any
+	-user-agent	the User-Agent header sent with every request
+	-X		the request method of the sequential / concurrent fetches (GET; POST when -d is given)
+	-d		their request body: a string ("name=gopher&lang=go") or "@file";
+			it is sent as application/x-www-form-urlencoded unless -H says otherwise
+	-H		an extra header field "Name: value" for the listed urls; repeat it for more,
+			it overrides the defaults (User-Agent, Content-Type, ...) and "Host: ..." sets the virtual host
+	-u		basic auth "user:password" for the listed urls
+	-bearer		a token sent as "Authorization: Bearer <token>" to the listed urls (instead of -u)
+			-H, -u and -bearer go to the listed urls only (the pages of -check and -monitor too, with a GET),
+			and to the pages of a -crawl, which never leaves their hosts: never to robots.txt, nor to the links
+			-check follows, which may be on other hosts (and a redirect to another host drops the credentials)
+	-robots		fetch robots.txt once per site and skip what it disallows for -user-agent
+			(Allow / Disallow with * and $, longest match wins; Crawl-delay slows the host down);
+			skipped urls are reported as SKIPPED, with the rule that blocked them; as RFC 9309 asks,
+			nothing is fetched from a site whose robots.txt is unreachable or answers 5xx: its urls are
+			reported as ROBOTS, with the robots.txt error, and count as failed (a dead host isn't a skip)
+	-monitor	monitor mode: poll every url at this interval (until Ctrl-C / -deadline), hash each body
+			with SHA-256, and print every change: first answer, status code, content, down / up
+	-history	monitor mode: the JSON Lines file the changes are appended to (fetch-history.jsonl);
+			a new run picks up where the last one stopped
+	-har		write every fetch (of the fetch, crawl and link-check modes) into a HAR 1.2 file, for browser
+			devtools and other HAR viewers: request / response headers, status, sizes and timings
+			(dns, connect, ssl, send, wait, receive, from httptrace); one entry per url, for its last attempt
+			after redirects, with the attempts, result kind and error as _attempts / _kind / _error
+	-har-bodies	with -har: include the response bodies (base64 when they aren't UTF-8), up to 1 MiB each
+	-rate		at most this many requests per second to each host, on average (a token bucket)
+	-burst		how many requests a host may get back-to-back before -rate kicks in
+
+	The "report" subcommand reads a -history file and prints, per url, the time it was monitored,
+	its downtime and uptime percentage, the number of outages and changes, then its timeline.
+	A url counts as down when it gets no answer, or a 4xx / 5xx one.
+
+	A failed url doesn't stop the others. The run ends with a summary table (per mode: ok / failed /
+	skipped / not run, then every failure), and its exit status tells how it went:
+		0	every url succeeded (a url skipped because of robots.txt is not a failure)
+		2	bad flags
+		3	partial failure: some urls failed (no answer, or a 4xx / 5xx one), or were not run (Ctrl-C / -deadline)
+		4	total failure: no url succeeded
+
+	A url may be a bare host ("example.com", "example.com:8080/a", "::1", "[::1]:8080"),
+	or an absolute http:// / https:// url; anything else is reported as INVALID. For offline work,
+	two more schemes are served locally, with the same status / size / time fields as the network ones:
+		file:///abs/path (file:rel/path too)	a file, or a directory as an HTML list of links; 404 if missing
+		data:[<type>][;base64],<data>		RFC 2397, e.g. "data:,Hello%2C%20World" or "data:text/plain;base64,SGk="
+	(retries, -robots, -rate, -cache and compression don't apply to them)
+
+	Ctrl-C cancels whatever is still running; a 2nd Ctrl-C kills the process.
+	A url that runs out of time is reported as TIMEOUT, one cut short by Ctrl-C as CANCELED.
+
+	Only transient failures are retried: network errors (connection reset / refused, timeouts ...)
+	and the status codes 408 / 425 / 429 / 500 / 502 / 503 / 504; an unknown host, a bad certificate
+	or too many redirects would fail again the same way.
+	A "Retry-After" header (seconds or an HTTP date) overrides the computed backoff.
+	Retries cover the request up to the response headers; a body cut off halfway is not re-fetched.
+	They apply to every method: use -attempts 1 when a repeated POST would do harm.
+
+	Compression: every GET asks for "Accept-Encoding: gzip, deflate" and decodes the body itself, so each
+	result tells its Content-Encoding ("identity" when the server didn't compress), the bytes on the wire,
+	the decoded bytes and their ratio; an encoding it can't decode (br, zstd ...) is flagged as unsupported
+	and its body is left as it came. Each mode ends with a count per encoding and the overall ratio.
+	Not with -o -resume / -chunks (Range offsets are those of the plain body), nor when -H sets Accept-Encoding.
+
+	Every result carries the phases of its (last) attempt, taken with net/http/httptrace:
+	dns, connect (TCP), tls and ttfb (time to first byte, measured from asking for a connection);
+	each mode ends with their average / maximum over the run.
 */
 
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 )
 
-func main() {
-	// 顺序式
-	sequential_fetch()
-	// 并发式
-	concurrent_fetch()
+var (
+	workers    = flag.Int("workers", 16, "maximum number of fetches in flight overall")
+	perHost    = flag.Int("per-host", 4, "maximum number of fetches in flight per host (0 = unlimited)")
+	timeout    = flag.Duration("timeout", 10*time.Second, "time limit per url (0 = unlimited)")
+	deadline   = flag.Duration("deadline", 0, "time limit for the whole run (0 = unlimited)")
+	attempts   = flag.Int("attempts", 3, "maximum number of attempts per url")
+	backoff    = flag.Duration("backoff", 200*time.Millisecond, "delay before the first retry")
+	maxBackoff = flag.Duration("max-backoff", 5*time.Second, "upper bound on a single retry delay")
+	format     = flag.String("format", "text", "output format: text, json or csv")
+	httpsFirst = flag.Bool("https", false, "use https for urls without a scheme, and upgrade http:// to https://")
+	outDir     = flag.String("o", "", "save each body into this directory (with a manifest.json) instead of printing / discarding it")
+	cacheDir   = flag.String("cache", "", "keep bodies in this directory and revalidate them on later runs")
+	benchN     = flag.Int("bench", 0, "benchmark mode: fetch every url this many times, sequentially then concurrently")
+	crawl      = flag.Bool("crawl", false, "crawl mode: follow <a href> links on the starting hosts")
+	crawlDepth = flag.Int("depth", 2, "crawl mode: how many links away from the starting urls to go")
+	checkMode  = flag.Bool("check", false, "link-check mode: report broken href / src links of the given pages")
+	userAgent  = flag.String("user-agent", "fetch/1.0", "User-Agent header, and the name looked up in robots.txt")
+	obeyRobots = flag.Bool("robots", false, "honor robots.txt (Allow / Disallow / Crawl-delay) for -user-agent")
+	rate       = flag.Float64("rate", 0, "maximum requests per second to each host (0 = unlimited)")
+	burst      = flag.Int("burst", 1, "requests a host may get back-to-back before -rate applies")
+	mode       = flag.String("mode", "both", "which fetcher(s) to run: sequential, concurrent or both")
+	inputFile  = flag.String("i", "", `read urls from this file, one per line ("-" = stdin)`)
+	resume     = flag.Bool("resume", false, "with -o: keep unfinished downloads, and continue them on the next run")
+	chunks     = flag.Int("chunks", 1, "with -o: download a large body in up to this many parallel Range requests")
+	progress   = flag.Bool("progress", false, "with -o: show a progress bar per download on stderr")
+	pollEvery  = flag.Duration("monitor", 0, "monitor mode: poll the urls at this interval and log every change")
+	history    = flag.String("history", "fetch-history.jsonl", "monitor mode: the file the changes are appended to")
+	harFile    = flag.String("har", "", "write every request and response into this HAR 1.2 file")
+	harBodies  = flag.Bool("har-bodies", false, "with -har: include the response bodies (up to 1 MiB each)")
+	method     = flag.String("X", "", "request method (default GET, or POST with -d)")
+	data       = flag.String("d", "", `request body, or "@file" to send the content of a file`)
+	basicAuth  = flag.String("u", "", `basic auth as "user:password"`)
+	bearer     = flag.String("bearer", "", "bearer token for the Authorization header")
+	headers    = make(headerList)
+)
+
+func init() {
+	flag.Var(headers, "H", `extra header "Name: value" (repeatable)`)
 }
 
-func sequential_fetch() {
-	start := time.Now()
-	for idx, url := range os.Args[1:] {
-		sub_start := time.Now()
+// saver is set when -o is given, cache when -cache is
+var (
+	saver *bodySaver
+	cache *httpCache
+)
 
-		// Add the url-protocol prefix if it is missing
-		const prefix = "http://"
-		if !strings.HasPrefix(url, prefix) {
-			url = prefix + url
-		}
+// request is what -X / -d / -H / -u / -bearer make of the fetches of the sequential / concurrent modes
+var request requestSpec
+
+// robots is set when -robots is given; polite when -rate or -robots is (Crawl-delay needs it)
+var (
+	robots *robotsPolicy
+	polite *politeness
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(report(os.Args[2:]))
+	}
+	flag.Parse()
+	if *workers < 1 {
+		*workers = 1
+	}
 
-		//【http.Get】makes an HTTP request
-		resp, err := http.Get(url)
+	//【context.Context】carries cancellation (Ctrl-C) and the overall deadline to every request
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		// restore the default behaviour, so that a 2nd Ctrl-C kills the process
+		<-ctx.Done()
+		stop()
+	}()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
 
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error during fetching: %v\n", err)
+	out, err := newResultWriter(*format, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	if request, err = newRequestSpec(*method, *data, http.Header(headers), *basicAuth, *bearer); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	if *obeyRobots {
+		robots = newRobotsPolicy(*userAgent)
+	}
+	if *rate > 0 || *obeyRobots {
+		polite = newPoliteness(*rate, *burst)
+	}
+
+	switch *mode {
+	case "sequential", "concurrent", "both":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -mode %q (want sequential, concurrent or both)\n", *mode)
+		os.Exit(exitUsage)
+	}
+	modes := 1
+	if *mode == "both" {
+		modes = 2
+	}
+	if *inputFile == "" && flag.NArg() == 0 {
+		// no urls on the command line: read them from stdin
+		*inputFile = "-"
+	}
+	open, cleanup, err := jobSource(flag.Args(), *inputFile, modes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	defer cleanup()
+
+	if *benchN > 0 {
+		benchmark(ctx, collect(open(ctx)), out)
+		return
+	}
+	if *pollEvery > 0 {
+		if err := monitor(ctx, collect(open(ctx)), out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			cleanup()
+			os.Exit(exitUsage)
+		}
+		return
+	}
+
+	if *harFile != "" {
+		har = newHARRecorder(*harBodies)
+	}
+	if *crawl {
+		crawl_fetch(ctx, collect(open(ctx)), out)
+		writeHAR()
+		return
+	}
+	if *checkMode {
+		ok := check_links(ctx, collect(open(ctx)), out)
+		writeHAR()
+		cleanup()
+		if !ok {
 			os.Exit(1)
 		}
+		return
+	}
+
+	if *outDir != "" {
+		if saver, err = newBodySaver(*outDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		if *progress {
+			board = newProgressBoard(os.Stderr)
+			go board.run()
+			out.w, out.log = board.above(out.w), board.above(out.log)
+			if out.csv != nil {
+				out.csv = csv.NewWriter(out.w)
+			}
+		}
+	}
 
-		// the【Body】field of resp is a readable stream
-		respBody := resp.Body
-		// read the entire response using【ioutil.ReadAll】
-		data, err := ioutil.ReadAll(respBody)
-		// close the stream to avoid leakign resources
-		respBody.Close()
+	if *cacheDir != "" {
+		if cache, err = newHTTPCache(*cacheDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+	}
 
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error during reading: %v\n", err)
-			os.Exit(1)
+	var tallies []*modeTally
+	if *mode != "concurrent" {
+		// 顺序式
+		tallies = append(tallies, sequential_fetch(ctx, open(ctx), out))
+	}
+	if *mode != "sequential" {
+		// 并发式
+		tallies = append(tallies, concurrent_fetch(ctx, open(ctx), out))
+	}
+
+	if board != nil {
+		board.stop()
+	}
+	if cache != nil {
+		fmt.Fprintln(out.log, cache)
+	}
+	if saver != nil {
+		if err := saver.writeManifest(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error during writing the manifest: %v\n", err)
 		}
+	}
+	writeHAR()
+	code := printSummary(out.log, tallies)
+	// os.Exit skips deferred calls
+	cleanup()
+	os.Exit(code)
+}
+
+// writeHAR writes the -har file, if there is one
+func writeHAR() {
+	if har == nil {
+		return
+	}
+	if err := har.write(*harFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error during writing %s: %v\n", *harFile, err)
+	}
+}
 
-		// time cost of each task
-		fmt.Printf("【%d】Status: %s Time: %.2fs elapsed (%s)\n Content: %s ...\n", idx, resp.Status, time.Since(sub_start).Seconds(), url, data)
+// sequential_fetch fetches urls one by one; a failed url doesn't stop the ones after it
+func sequential_fetch(ctx context.Context, jobs <-chan job, out *resultWriter) *modeTally {
+	start := time.Now()
+	phases := newPhaseSummary()
+	encodings := newEncodingSummary()
+	tally := newModeTally("sequential")
+	for j := range jobs {
+		if ctx.Err() != nil {
+			// Ctrl-C or the overall deadline: the rest of the list would fail the same way;
+			// it is still read to the end, to be counted as not run
+			tally.notRun++
+			continue
+		}
+		var result fetchResult
+		if saver != nil {
+			// the body goes to a file instead
+			result = fetchURL(ctx, j.idx, j.url, ioutil.Discard)
+		} else {
+			// read the entire response into memory, so that the text output can show it
+			var data bytes.Buffer
+			result = fetchURL(ctx, j.idx, j.url, &data)
+			result.content = data.Bytes()
+		}
+		result.Line = j.line
+		result.Mode = "sequential"
+		out.write(result)
+		phases.add(result)
+		encodings.add(result)
+		tally.add(result)
 	}
 
 	// total time cost
-	fmt.Printf("in total: %.2fs elapsed\n", time.Since(start).Seconds())
+	out.flush()
+	fmt.Fprintf(out.log, "in total: %.2fs elapsed\n", time.Since(start).Seconds())
+	fmt.Fprintln(out.log, phases)
+	fmt.Fprintln(out.log, encodings)
+	return tally
+}
+
+// a unit of work handed to the worker pool
+type job struct {
+	idx  int // position in the list, once blank lines / comments / duplicates are left out
+	line int // line number in the -i input (0 for command-line arguments)
+	url  string
+	host string // filled in by runPool, for the -per-host limit
 }
 
-func concurrent_fetch() {
+func concurrent_fetch(ctx context.Context, jobs <-chan job, out *resultWriter) *modeTally {
 	start := time.Now()
-	// create a【channel】of string using【make】
-	ch := make(chan string)
+	// create a【channel】of fetchResult using【make】
+	ch := make(chan fetchResult)
+	stats := &poolStats{}
+	go runPool(ctx, *workers, *perHost, jobs, ch, stats, fetch)
 
-	for idx, url := range os.Args[1:] {
-		// start a【goroutine】
-		go fetch(url, ch, idx)
-	}
-	for range os.Args[1:] {
+	phases := newPhaseSummary()
+	encodings := newEncodingSummary()
+	tally := newModeTally("concurrent")
+	for result := range ch {
 		// receive from【channel】ch
-		fmt.Println(<-ch)
+		result.Mode = "concurrent"
+		out.write(result)
+		phases.add(result)
+		encodings.add(result)
+		tally.add(result)
 	}
 
 	// total time cost
-	fmt.Printf("in total: %.2fs elapsed\n", time.Since(start).Seconds())
+	out.flush()
+	fmt.Fprintf(out.log, "in total: %.2fs elapsed\n", time.Since(start).Seconds())
+	fmt.Fprintln(out.log, stats)
+	fmt.Fprintln(out.log, phases)
+	fmt.Fprintln(out.log, encodings)
+	// what was never started (Ctrl-C / -deadline): dispatch reads the rest of the list to count it
+	tally.notRun = stats.queued
+	return tally
+}
+
+// runPool fetches the urls of src with n workers, at most perHost of them on one host (0 = no limit),
+// sending every result to ch, and closes ch once all of them are done. Each job is handed to do (fetch, for a list).
+func runPool(ctx context.Context, n, perHost int, src <-chan job, ch chan<- fetchResult, stats *poolStats,
+	do func(ctx context.Context, j job, ch chan<- fetchResult)) {
+
+	// an unbuffered【channel】of jobs: a worker only receives once it is free,
+	// and only a job whose host has a free slot is sent (see dispatch)
+	jobs := make(chan job)
+	hosts := newHostLimiter(perHost)
+
+	// start a FIXED number of【goroutines】instead of one per url,
+	// so at most n connections are open at any moment
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				stats.start()
+				do(ctx, j, ch)
+				stats.finish()
+				hosts.release(j.host)
+			}
+		}()
+	}
+
+	// the producer: close【jobs】once every url is handed out, so the workers' range loops end;
+	// after Ctrl-C / the deadline it stops handing out work, and the leftovers (the rest of src too) stay "queued"
+	go dispatch(ctx, src, jobs, hosts, stats)
+
+	// close【ch】once every worker is done, so the receiver's range loop ends
+	wg.Wait()
+	close(ch)
+}
+
+// maxWaiting bounds the jobs dispatch holds back for busy hosts, so that a long list is still read as it goes
+const maxWaiting = 4096
+
+// dispatch hands the jobs of src out on jobs, each once its host has a free slot (-per-host); the slot is
+// released by the worker. A job for a busy host waits here, NOT in a worker, so the jobs for the other hosts
+// get past it, and a list sorted by host still keeps every worker busy. It closes jobs when done.
+func dispatch(ctx context.Context, src <-chan job, jobs chan<- job, hosts *hostLimiter, stats *poolStats) {
+	defer close(jobs)
+	var waiting []job
+	var next job // the slot of its host is taken: the job to hand out next
+	ready := false
+	for src != nil || len(waiting) > 0 || ready {
+		if !ready {
+			for i, j := range waiting {
+				if hosts.tryAcquire(j.host) {
+					next, ready = j, true
+					waiting = append(waiting[:i], waiting[i+1:]...)
+					break
+				}
+			}
+		}
+		// a nil【channel】blocks forever: it turns its case of the select off
+		var out chan<- job
+		if ready {
+			out = jobs
+		}
+		in := src
+		if len(waiting) >= maxWaiting {
+			in = nil
+		}
+		select {
+		case out <- next:
+			ready = false
+		case j, ok := <-in:
+			if !ok {
+				src = nil
+				continue
+			}
+			stats.queue()
+			j.host = hostOf(j.url)
+			waiting = append(waiting, j)
+		case <-hosts.freed:
+			// a slot was released: look for a job that can go now
+		case <-ctx.Done():
+			// count the rest as not run; the sources never stop early, so this reads src to its end
+			for range src {
+				stats.queue()
+			}
+			return
+		}
+	}
+}
+
+func fetch(ctx context.Context, j job, ch chan<- fetchResult) {
+	// discard the response and report the size instead
+	result := fetchURL(ctx, j.idx, j.url, ioutil.Discard)
+	result.Line = j.line
+	// send to【channel】ch
+	ch <- result
 }
 
-func fetch(url string, ch chan <- string, idx int) {
+// fetchURL fetches ONE url, copies its body into dst, and reports how it went.
+// With -o, a successful (2xx) body is saved to a file instead of going to dst.
+func fetchURL(ctx context.Context, idx int, url string, dst io.Writer) fetchResult {
+	return fetchURLTo(ctx, idx, request, url, dst, saver)
+}
+
+// fetchURLTo is fetchURL with an explicit request (method, body, header fields),
+// and an explicit saver (nil: every body goes to dst). Only GETs go through the -cache.
+func fetchURLTo(ctx context.Context, idx int, spec requestSpec, url string, dst io.Writer, saver *bodySaver) (result fetchResult) {
 	sub_start := time.Now()
-		
-	// Add the url-protocol prefix if it is missing
-	const prefix = "http://"
-	if !strings.HasPrefix(url, prefix) {
-		url = prefix + url
+	method, body := spec.method, spec.body
+
+	result = fetchResult{Index: idx, URL: url}
+	url, err := normalizeURL(url)
+	if err != nil {
+		result.Kind = kindInvalid
+		result.Err = err
+		return result
+	}
+	result.URL = url
+
+	// file:, data: ... are served by their handler, without a network
+	handler := handlerFor(url)
+
+	// with -robots, robots.txt may rule the url out
+	if robots != nil && handler == nil {
+		ok, reason, err := robots.allowed(ctx, url)
+		if err != nil {
+			// the whole site is off limits, but that's no choice of its own: a failure, not a skip
+			result.Kind = kindRobots
+			result.Err = err
+			result.Elapsed = time.Since(sub_start)
+			return result
+		}
+		if !ok {
+			result.Kind = kindSkipped
+			result.Err = errors.New(reason)
+			result.Elapsed = time.Since(sub_start)
+			return result
+		}
+	}
+
+	// with -cache, ask the server whether the stored copy is still good
+	header := make(http.Header)
+	for key, values := range spec.header {
+		header[key] = values
+	}
+	var stored *cacheMeta
+	cache := cache
+	if method != http.MethodGet || handler != nil {
+		cache = nil
+	}
+	if cache != nil {
+		if stored = cache.lookup(url); stored != nil {
+			stored.conditional(header)
+		}
+	}
+
+	// with -resume, ask for the rest of a download an earlier run left unfinished
+	var part *partMeta
+	if saver != nil && *resume && method == http.MethodGet && stored == nil && handler == nil {
+		if part = saver.partial(url); part != nil {
+			part.resume(header)
+		}
+	}
+
+	// ask for gzip / deflate and decode the body here, rather than in the transport, so that both sizes are known.
+	// Not for Range requests (-resume, -chunks): their offsets are those of the plain body.
+	compress := handler == nil && method != http.MethodHead && !(saver != nil && (*resume || *chunks > 1)) &&
+		spec.header.Get("Accept-Encoding") == ""
+	if compress {
+		header.Set("Accept-Encoding", "gzip, deflate")
+	}
+
+	// with -har, the exchange is recorded however it ends
+	var ex *harExchange
+	if har != nil {
+		ex = &harExchange{method: method, url: url, body: body}
+		defer func() { har.add(ex, result) }()
 	}
 
-	//【http.Get】makes an HTTP request
-	resp, err := http.Get(url)
+	// makes an HTTP request bounded by -timeout, retried by -attempts
+	var (
+		resp   *http.Response
+		cancel context.CancelFunc
+		tries  int
+	)
+	if handler != nil {
+		// nothing to retry, and nothing to cancel once the body is read
+		resp, err = handler.roundTrip(ctx, method, url, body)
+		cancel, tries = func() {}, 1
+	} else {
+		resp, cancel, tries, err = send(ctx, method, url, body, header, &result.Phases)
+	}
+	result.Attempts = tries
 
 	if err != nil {
-		// send to【channel】ch
-		ch <- fmt.Sprint(err)
-		return
+		return result.failed(err, sub_start)
+	}
+	defer cancel()
+	if saver != nil {
+		idleTimeout(resp)
+	}
+	var wire *countingReader
+	if compress {
+		wire, result.Encoding, result.EncodingSupported, err = decodeBody(resp)
+		if err != nil {
+			resp.Body.Close()
+			return result.failed(err, sub_start)
+		}
+	}
+	if ex != nil {
+		ex.resp, ex.headersAt = resp, time.Now()
+		if har.bodies {
+			resp.Body = ex.capture(resp.Body)
+		}
+	}
+	result.Status = resp.StatusCode
+	result.ContentType = resp.Header.Get("Content-Type")
+	result.finalURL = resp.Request.URL
+
+	if stored != nil && resp.StatusCode == http.StatusNotModified {
+		// 304: the body comes from disk instead of the network
+		if err := cache.hit(stored, resp); err != nil {
+			resp.Body.Close()
+			return result.failed(err, sub_start)
+		}
+		result.Cached = true
+	} else if cache != nil {
+		cache.fill(url, resp)
 	}
 
 	// the【Body】field of resp is a readable stream
 	respBody := resp.Body
-	// discard the response and report the size instead
-	nbytes, err := io.Copy(ioutil.Discard, respBody)
+	var nbytes int64
+	if saver != nil && (resp.StatusCode/100 == 2 || result.Cached) {
+		var entry manifestEntry
+		entry, err = saver.save(ctx, url, resp, part)
+		nbytes, result.SavedPath, result.SHA256 = entry.Bytes, entry.Path, entry.SHA256
+		result.Resumed, result.Chunks = entry.resumed, entry.chunks
+	} else {
+		if part != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// the partial download no longer fits the body: the next run starts over
+			saver.dropPartial(url)
+		}
+		nbytes, err = io.Copy(dst, respBody)
+	}
 	// close the stream to avoid leakign resources
 	respBody.Close()
+	result.Bytes = nbytes
+
+	if err != nil {
+		// the body can run out of time too
+		return result.failed(err, sub_start)
+	}
+
+	if wire != nil {
+		result.WireBytes = wire.n
+	}
 
 	// time cost of each task
-	ch <- fmt.Sprintf("【%d】Status: %s Time: %.2fs elapsed (%s)\n Count: (%7d bytes)\n", idx, resp.Status, time.Since(sub_start).Seconds(), url, nbytes)
+	result.Kind = kindOK
+	result.Elapsed = time.Since(sub_start)
+	return result
+}
+
+// result categories
+const (
+	kindOK       = "OK"
+	kindError    = "ERROR"
+	kindTimeout  = "TIMEOUT"
+	kindCanceled = "CANCELED"
+	kindInvalid  = "INVALID" // the url itself is malformed or has an unsupported scheme
+	kindSkipped  = "SKIPPED" // not fetched: robots.txt disallows it
+	kindRobots   = "ROBOTS"  // not fetched: robots.txt can't be had (unreachable / 5xx), so the site is off limits
+)
+
+// fetchResult is the outcome of fetching ONE url; it's what travels over the【channel】
+type fetchResult struct {
+	Mode     string // the fetcher that made it: sequential or concurrent (both run with -mode both)
+	Index    int
+	Line     int // in the -i input, 0 for command-line arguments
+	URL      string
+	Kind     string // one of the kind... constants above
+	Status   int    // HTTP status code, 0 if no response arrived
+	Bytes    int64
+	Elapsed  time.Duration
+	Attempts int
+	Err      error
+	Phases   phaseTimings // of the last attempt
+
+	ContentType string
+
+	finalURL *url.URL // where the last redirect led
+
+	Cached    bool   // with -cache: a 304, the body came from the cache
+	SavedPath string // with -o: where the body went
+	SHA256    string // with -o: hex digest of the saved body
+	Resumed   int64  // with -o -resume: bytes an earlier run had downloaded already
+	Chunks    int    // with -o: number of Range requests the body was split into (-chunks)
+
+	Encoding          string // the Content-Encoding ("identity" for none), "" if compression wasn't asked for
+	EncodingSupported bool   // gzip / deflate / identity: Bytes is the decoded size
+	WireBytes         int64  // the body as received, before decoding
+
+	content []byte // the body itself, shown by the text output of sequential_fetch only
+}
+
+// failed fills in the error fields of r
+func (r fetchResult) failed(err error, start time.Time) fetchResult {
+	r.Kind = errCategory(err)
+	r.Err = err
+	r.Elapsed = time.Since(start)
+	return r
+}
+
+// label is what goes between the【】of the text output: the index, and the input line if there is one
+func (r fetchResult) label() string {
+	if r.Line > 0 {
+		return fmt.Sprintf("%d, line %d", r.Index, r.Line)
+	}
+	return strconv.Itoa(r.Index)
+}
+
+// errString is "" when there is no error, so that it can be an empty JSON / CSV field
+func (r fetchResult) errString() string {
+	if r.Err == nil {
+		return ""
+	}
+	return r.Err.Error()
+}
+
+// MarshalJSON spells the duration out in milliseconds and the error as a string
+func (r fetchResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Mode      string  `json:"mode,omitempty"`
+		Index     int     `json:"index"`
+		Line      int     `json:"line,omitempty"`
+		URL       string  `json:"url"`
+		Kind      string  `json:"kind"`
+		Status    int     `json:"status"`
+		Bytes     int64   `json:"bytes"`
+		ElapsedMS float64 `json:"elapsed_ms"`
+		Attempts  int     `json:"attempts"`
+		DNSMS     float64 `json:"dns_ms"`
+		ConnectMS float64 `json:"connect_ms"`
+		TLSMS     float64 `json:"tls_ms"`
+		TTFBMS    float64 `json:"ttfb_ms"`
+		Reused    bool    `json:"reused_conn"`
+		Error     string  `json:"error,omitempty"`
+		Cached    bool    `json:"cached,omitempty"`
+		SavedPath string  `json:"saved_path,omitempty"`
+		SHA256    string  `json:"sha256,omitempty"`
+		Resumed   int64   `json:"resumed_from,omitempty"`
+		Chunks    int     `json:"chunks,omitempty"`
+		Encoding  string  `json:"encoding,omitempty"`
+		Wire      int64   `json:"wire_bytes,omitempty"`
+		Ratio     float64 `json:"compression_ratio,omitempty"`
+		Unknown   bool    `json:"unsupported_encoding,omitempty"`
+	}{r.Mode, r.Index, r.Line, r.URL, r.Kind, r.Status, r.Bytes, r.Elapsed.Seconds() * 1000, r.Attempts,
+		r.Phases.DNS.Seconds() * 1000, r.Phases.Connect.Seconds() * 1000, r.Phases.TLS.Seconds() * 1000, r.Phases.TTFB.Seconds() * 1000, r.Phases.Reused,
+		r.errString(), r.Cached, r.SavedPath, r.SHA256, r.Resumed, r.Chunks,
+		r.Encoding, r.WireBytes, r.ratio(), r.Encoding != "" && !r.EncodingSupported})
+}
+
+var csvHeader = []string{"mode", "index", "line", "url", "kind", "status", "bytes", "elapsed_ms", "attempts", "dns_ms", "connect_ms", "tls_ms", "ttfb_ms", "reused_conn", "error", "cached", "saved_path", "sha256", "resumed_from", "chunks", "encoding", "wire_bytes", "compression_ratio", "unsupported_encoding"}
+
+func (r fetchResult) csvRecord() []string {
+	return []string{
+		r.Mode,
+		strconv.Itoa(r.Index),
+		strconv.Itoa(r.Line),
+		r.URL,
+		r.Kind,
+		strconv.Itoa(r.Status),
+		strconv.FormatInt(r.Bytes, 10),
+		msField(r.Elapsed),
+		strconv.Itoa(r.Attempts),
+		msField(r.Phases.DNS),
+		msField(r.Phases.Connect),
+		msField(r.Phases.TLS),
+		msField(r.Phases.TTFB),
+		strconv.FormatBool(r.Phases.Reused),
+		r.errString(),
+		strconv.FormatBool(r.Cached),
+		r.SavedPath,
+		r.SHA256,
+		strconv.FormatInt(r.Resumed, 10),
+		strconv.Itoa(r.Chunks),
+		r.Encoding,
+		strconv.FormatInt(r.WireBytes, 10),
+		strconv.FormatFloat(r.ratio(), 'f', 3, 64),
+		strconv.FormatBool(r.Encoding != "" && !r.EncodingSupported),
+	}
+}
+
+// msField formats a duration as a plain number of milliseconds, for CSV
+func msField(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds()*1000, 'f', 3, 64)
+}
+
+// resultWriter prints results in the -format of choice:
+//	text	the human-readable 【idx】 lines
+//	json	JSON Lines, one object per url
+//	csv		a header row (written with the first row), then one row per url
+// Anything that isn't a result (totals, summaries) goes to log,
+// which is stderr for json / csv so that stdout stays machine-readable.
+type resultWriter struct {
+	format string
+	w      io.Writer
+	log    io.Writer
+	csv    *csv.Writer
+
+	csvStarted bool // the header row has been written
+}
+
+func newResultWriter(format string, w io.Writer) (*resultWriter, error) {
+	out := &resultWriter{format: format, w: w, log: os.Stderr}
+	switch format {
+	case "text":
+		out.log = w
+	case "json":
+	case "csv":
+		out.csv = csv.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown -format %q (want text, json or csv)", format)
+	}
+	return out, nil
+}
+
+func (out *resultWriter) write(r fetchResult) {
+	statusText := http.StatusText(r.Status)
+	if r.Cached {
+		statusText = "cached"
+	}
+	switch out.format {
+	case "json":
+		data, _ := json.Marshal(r)
+		fmt.Fprintf(out.w, "%s\n", data)
+	case "csv":
+		out.csvHeader(csvHeader)
+		out.csv.Write(r.csvRecord())
+	default:
+		if r.Kind != kindOK {
+			fmt.Fprintf(out.w, "【%s】%s after %.2fs, %d attempt(s) (%s): %v\n", r.label(), r.Kind, r.Elapsed.Seconds(), r.Attempts, r.URL, r.Err)
+		} else if r.content != nil {
+			fmt.Fprintf(out.w, "【%s】Status: %d %s Attempts: %d Time: %.2fs elapsed (%s)\n Content: %s ...\n", r.label(), r.Status, statusText, r.Attempts, r.Elapsed.Seconds(), r.URL, r.content)
+			fmt.Fprintf(out.w, " Phases: %s\n", r.Phases)
+			if r.Encoding != "" {
+				fmt.Fprintf(out.w, " Encoding: %s\n", r.encodingText())
+			}
+		} else {
+			fmt.Fprintf(out.w, "【%s】Status: %d %s Attempts: %d Time: %.2fs elapsed (%s)\n Count: (%7d bytes)\n", r.label(), r.Status, statusText, r.Attempts, r.Elapsed.Seconds(), r.URL, r.Bytes)
+			fmt.Fprintf(out.w, " Phases: %s\n", r.Phases)
+			if r.Encoding != "" {
+				fmt.Fprintf(out.w, " Encoding: %s\n", r.encodingText())
+			}
+			if r.SavedPath != "" {
+				fmt.Fprintf(out.w, " Saved: %s (sha256 %s)", r.SavedPath, r.SHA256)
+				if r.Resumed > 0 {
+					fmt.Fprintf(out.w, " resumed at %d bytes", r.Resumed)
+				}
+				if r.Chunks > 1 {
+					fmt.Fprintf(out.w, " in %d chunks", r.Chunks)
+				}
+				fmt.Fprintln(out.w)
+			}
+			fmt.Fprintln(out.w)
+		}
+	}
+}
+
+// csvHeader writes header, unless a header was written already
+func (out *resultWriter) csvHeader(header []string) {
+	if !out.csvStarted {
+		out.csv.Write(header)
+		out.csvStarted = true
+	}
+}
+
+// flush pushes out whatever the csv.Writer still buffers
+func (out *resultWriter) flush() {
+	if out.csv != nil {
+		out.csv.Flush()
+	}
+}
+
+// send makes a request, retrying transient failures according to -attempts / -backoff, all of it bounded by -timeout.
+// It reports how many attempts were made, successful or not, and the phases of the last one.
+// The caller must call cancel once it is done with resp.Body.
+func send(ctx context.Context, method, url string, body []byte, header http.Header, phases *phaseTimings) (resp *http.Response, cancel context.CancelFunc, tries int, err error) {
+	policy := retryPolicy{attempts: *attempts, base: *backoff, max: *maxBackoff}
+	// ONE time limit for the url, not one per attempt: the body has to arrive in what is left of it
+	// (unless idleTimeout makes it a limit on the time between two reads of the body).
+	// A timer rather than context.WithTimeout, as a deadline can't be moved.
+	ctx, cancelURL := context.WithCancelCause(ctx)
+	var timer *time.Timer // nil: no -timeout
+	if *timeout > 0 {
+		timer = time.AfterFunc(*timeout, func() { cancelURL(errTimeout) })
+	}
+	stop := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	defer func() {
+		if resp == nil {
+			stop()
+			cancelURL(nil)
+			err = timedOut(ctx, err)
+			return
+		}
+		resp.Body = &timeoutBody{ReadCloser: resp.Body, ctx: ctx, timer: timer}
+		cancelAttempt := cancel
+		cancel = func() {
+			stop()
+			cancelAttempt()
+			cancelURL(nil)
+		}
+	}()
+	for tries = 1; ; tries++ {
+		// every attempt is a request, and takes a token from the host's bucket
+		if polite != nil {
+			if err := polite.wait(ctx, hostOf(url)); err != nil {
+				return nil, nil, tries, err
+			}
+		}
+		traced, timings := withTrace(ctx)
+		resp, cancel, err = sendOnce(traced, method, url, body, header)
+		*phases = timings()
+		if tries >= policy.attempts || ctx.Err() != nil {
+			return resp, cancel, tries, err
+		}
+		var retryAfter time.Duration
+		if err != nil {
+			if !policy.retryableErr(err) {
+				return nil, nil, tries, err
+			}
+		} else {
+			if !policy.retryableStatus(resp.StatusCode) {
+				return resp, cancel, tries, nil
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			// drain the body so that the connection can be reused by the next attempt
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			cancel()
+		}
+		if err := sleep(ctx, policy.delay(tries, retryAfter)); err != nil {
+			return nil, nil, tries, err
+		}
+	}
+}
+
+// errTimeout is why the context of a url is canceled when it runs out of -timeout
+var errTimeout = fmt.Errorf("%w (-timeout)", context.DeadlineExceeded)
+
+// timedOut makes a plain "context canceled" caused by -timeout running out an errTimeout, as errCategory expects
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && context.Cause(ctx) == errTimeout {
+		return fmt.Errorf("%w: %v", errTimeout, err)
+	}
+	return err
+}
+
+// timeoutBody is the body of a response sent by send, under the -timeout of its url
+type timeoutBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	timer *time.Timer // nil: no -timeout
+	idle  bool        // see idleTimeout
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.idle && b.timer != nil {
+		b.timer.Reset(*timeout)
+	}
+	if err != io.EOF {
+		err = timedOut(b.ctx, err)
+	}
+	return n, err
+}
+
+// idleTimeout turns the -timeout of a url sent by send into a limit on the time without a byte of its body:
+// a download (-o) may take longer than -timeout as a whole, as long as it keeps going
+func idleTimeout(resp *http.Response) {
+	if b, ok := resp.Body.(*timeoutBody); ok {
+		b.idle = true
+		if b.timer != nil {
+			b.timer.Reset(*timeout)
+		}
+	}
+}
+
+// sendOnce makes a single request, with extra header fields.
+// Every request carries -user-agent; the body is read afresh on every attempt.
+func sendOnce(ctx context.Context, method, url string, body []byte, header http.Header) (resp *http.Response, cancel context.CancelFunc, err error) {
+	ctx, cancel = context.WithCancel(ctx)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	setHeaders(req, body, header)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return resp, cancel, nil
+}
+
+// setHeaders puts -user-agent and the extra header fields on req
+func setHeaders(req *http.Request, body []byte, header http.Header) {
+	if *userAgent != "" {
+		req.Header.Set("User-Agent", *userAgent)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	// the extra fields (-H among them) come after the defaults above, so that they can override them
+	for key, values := range header {
+		if key == "Host" {
+			// net/http ignores a Host header field: the request has a field of its own
+			req.Host = values[len(values)-1]
+			continue
+		}
+		req.Header[key] = values
+	}
+}
+
+// headerList collects the repeatable -H flag
+type headerList http.Header
+
+func (h headerList) String() string {
+	var fields []string
+	for key, values := range h {
+		for _, value := range values {
+			fields = append(fields, key+": "+value)
+		}
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ", ")
+}
+
+// Set takes "Name: value"; "Name:" (empty value) sends the field empty
+func (h headerList) Set(field string) error {
+	key, value, ok := strings.Cut(field, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return fmt.Errorf("bad header %q (want \"Name: value\")", field)
+	}
+	http.Header(h).Add(key, strings.TrimSpace(value))
+	return nil
+}
+
+// requestSpec is the method, body and header fields of a request
+type requestSpec struct {
+	method string
+	body   []byte      // nil: no body
+	header http.Header // -H and the -u / -bearer credentials: for the urls of the list only
+}
+
+// get is spec for the pages -crawl, -check and -monitor read: a GET with the header fields, without -X / -d
+func (spec requestSpec) get() requestSpec {
+	return requestSpec{method: http.MethodGet, header: spec.header}
+}
+
+// newRequestSpec reads -X and -d: "@file" takes the body from a file, and a body makes POST the default method;
+// and -H / -u / -bearer, which only go to the urls the user listed (and the pages of a crawl, on the same hosts):
+// NOT to the links a link check follows, nor to robots.txt, which may be on other hosts
+func newRequestSpec(method, data string, header http.Header, basicAuth, bearer string) (requestSpec, error) {
+	spec := requestSpec{method: strings.ToUpper(method), header: make(http.Header)}
+	for key, values := range header {
+		spec.header[key] = values
+	}
+	switch {
+	case basicAuth != "" && bearer != "":
+		return spec, errors.New("-u and -bearer both set the Authorization header: pick one")
+	case basicAuth != "":
+		spec.header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(basicAuth)))
+	case bearer != "":
+		spec.header.Set("Authorization", "Bearer "+bearer)
+	}
+	if data != "" {
+		if name, ok := strings.CutPrefix(data, "@"); ok {
+			body, err := os.ReadFile(name)
+			if err != nil {
+				return spec, err
+			}
+			spec.body = body
+		} else {
+			spec.body = []byte(data)
+		}
+	}
+	switch {
+	case spec.method == "" && spec.body != nil:
+		spec.method = http.MethodPost
+	case spec.method == "":
+		spec.method = http.MethodGet
+	case spec.method == http.MethodGet || spec.method == http.MethodHead:
+		if spec.body != nil {
+			return spec, fmt.Errorf("-d with -X %s: a %s request has no body", spec.method, spec.method)
+		}
+	}
+	return spec, nil
+}
+
+// retryPolicy decides which failures are worth another attempt, and how long to wait before it
+type retryPolicy struct {
+	attempts int           // maximum number of attempts, the 1st one included
+	base     time.Duration // delay before the 1st retry
+	max      time.Duration // upper bound on any computed delay
+}
+
+// retryableStatus reports whether the server asked us (more or less explicitly) to come back later
+func (p retryPolicy) retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryableErr reports whether err is transient: a timeout or a broken connection.
+// Malformed urls, unsupported schemes, unknown hosts, certificate errors, too many redirects etc.
+// fail the same way every time.
+func (p retryPolicy) retryableErr(err error) bool {
+	// http.Client wraps every error in a *url.Error, which is a net.Error itself: look inside it
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var (
+		dnsErr   *net.DNSError
+		certErr  *tls.CertificateVerificationError
+		authErr  x509.UnknownAuthorityError
+		hostErr  x509.HostnameError
+		validErr x509.CertificateInvalidError
+		netErr   net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		// -timeout and the overall deadline are checked by send before it asks
+		return true
+	case errors.As(err, &dnsErr):
+		// NXDOMAIN is an answer; a DNS server that doesn't answer may do so next time
+		return !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+	case errors.As(err, &certErr), errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &validErr):
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// delay computes the wait before attempt n+1: base * 2^(n-1), capped at max,
+// of which a random half is dropped ("jitter") so that clients failing together don't retry together.
+// A server-supplied Retry-After wins over the computed value.
+func (p retryPolicy) delay(n int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := p.base
+	for i := 1; i < n && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter understands both forms of the header: "120" (seconds) and an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// sleep waits for d, or returns early with ctx's error
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// errCategory sorts a failed fetch into kindTimeout, kindCanceled or a plain kindError
+func errCategory(err error) string {
+	// net.Error (wrapped by *url.Error) reports dial / read timeouts through Timeout()
+	var netErr interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return kindTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return kindTimeout
+	case errors.Is(err, context.Canceled):
+		return kindCanceled
+	}
+	return kindError
+}
+
+// the schemes fetchURL knows how to fetch
+var supportedSchemes = map[string]bool{"http": true, "https": true}
+
+// hasScheme matches an explicit "scheme://" prefix (RFC 3986: a letter, then letters / digits / + - .)
+var hasScheme = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// opaqueScheme matches a "scheme:" prefix without the "//" (mailto:a@b, javascript:...),
+// and hostPort what follows it when it is a host's port after all (example.com:8080/a)
+var (
+	opaqueScheme = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):`)
+	hostPort     = regexp.MustCompile(`^[0-9]*([/?#]|$)`)
+)
+
+// normalizeURL turns what the user typed into an absolute http(s) url:
+//	example.com			-> http://example.com/
+//	example.com:8080/a		-> http://example.com:8080/a
+//	::1, [::1]:8080			-> http://[::1]/, http://[::1]:8080/
+//	HTTPS://Example.COM:443		-> https://example.com/
+// file: and data: urls are left to their schemeHandler; other schemes (ftp://, ...) are rejected.
+// With -https, http becomes https.
+func normalizeURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("empty url")
+	}
+	if handler := handlerFor(raw); handler != nil {
+		return handler.normalize(raw)
+	}
+
+	// Add the url-protocol prefix if it is missing
+	if !hasScheme.MatchString(raw) {
+		// a bare IPv6 literal needs its brackets back before it can carry a scheme
+		host, rest := raw, ""
+		if i := strings.IndexAny(raw, "/?#"); i >= 0 {
+			host, rest = raw[:i], raw[i:]
+		}
+		if addr, err := netip.ParseAddr(host); err == nil && addr.Is6() {
+			// the zone separator (fe80::1%eth0) must be escaped inside a url
+			raw = "[" + strings.Replace(host, "%", "%25", 1) + "]" + rest
+		} else if m := opaqueScheme.FindStringSubmatch(raw); m != nil && !hostPort.MatchString(raw[len(m[0]):]) {
+			return "", fmt.Errorf("unsupported scheme %q in %q (want http, https, file or data)", strings.ToLower(m[1]), raw)
+		}
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if !supportedSchemes[u.Scheme] {
+		return "", fmt.Errorf("unsupported scheme %q in %q (want http, https, file or data)", u.Scheme, raw)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("missing host in %q", raw)
+	}
+	if *httpsFirst && u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+
+	// canonical form: lower-case host, no default port, "/" for an empty path
+	host, port := u.Hostname(), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	// an IPv6 zone is an interface name, which keeps its case
+	addr, zone, _ := strings.Cut(host, "%")
+	host = strings.ToLower(addr)
+	if zone != "" {
+		host += "%" + zone
+	}
+	if strings.Contains(host, ":") {
+		// an IPv6 literal; u.String() escapes its zone separator
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// schemeHandler serves the urls of a scheme other than http / https, without a network.
+// Its answers look like HTTP ones (a status, headers, a body), so that they travel through fetch,
+// the result types and the -o saver unchanged; to add a scheme, register a handler in schemeHandlers.
+// Retries, robots.txt, -rate, -cache and compression are for the network only, and don't apply.
+type schemeHandler interface {
+	// normalize checks a url of the scheme and returns its canonical form
+	normalize(raw string) (string, error)
+	// roundTrip answers a request for a normalized url
+	roundTrip(ctx context.Context, method, rawurl string, body []byte) (*http.Response, error)
+}
+
+var schemeHandlers = map[string]schemeHandler{
+	"file": fileScheme{},
+	"data": dataScheme{},
+}
+
+// handlerFor returns the handler of rawurl's scheme, nil for http / https (and bare hosts)
+func handlerFor(rawurl string) schemeHandler {
+	scheme, _, ok := strings.Cut(rawurl, ":")
+	if !ok {
+		return nil
+	}
+	return schemeHandlers[strings.ToLower(scheme)]
+}
+
+// localResponse builds the answer of a schemeHandler
+func localResponse(ctx context.Context, method, rawurl string, status int, header http.Header, body io.ReadCloser, size int64) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		// a data: url may hold what url.Parse refuses; its request only needs to say which url it was
+		scheme, rest, _ := strings.Cut(rawurl, ":")
+		u = &url.URL{Scheme: strings.ToLower(scheme), Opaque: rest}
+	}
+	req := (&http.Request{Method: method, URL: u, Header: make(http.Header)}).WithContext(ctx)
+	if body == nil || method == http.MethodHead {
+		if body != nil {
+			body.Close()
+		}
+		body = io.NopCloser(strings.NewReader(""))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}, nil
+}
+
+// fileScheme serves file:///absolute/path urls from the local disk:
+// a file as its content, a directory as an HTML list of links (so that -crawl can walk a tree),
+// 404 / 403 for a missing / unreadable path.
+type fileScheme struct{}
+
+// normalize accepts file:///path, file:/path, file://localhost/path and file:relative/path
+func (fileScheme) normalize(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file url %q names host %q: only local files can be read", raw, u.Host)
+	}
+	name := u.Path
+	if u.Opaque != "" {
+		// file:relative/path
+		if name, err = url.PathUnescape(u.Opaque); err != nil {
+			return "", err
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("missing path in %q", raw)
+	}
+	if name, err = filepath.Abs(name); err != nil {
+		return "", err
+	}
+	name = filepath.ToSlash(name)
+	if info, err := os.Stat(name); err == nil && info.IsDir() && !strings.HasSuffix(name, "/") {
+		// so that the links of its listing resolve inside it
+		name += "/"
+	}
+	return (&url.URL{Scheme: "file", Path: name}).String(), nil
+}
+
+func (fileScheme) roundTrip(ctx context.Context, method, rawurl string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	if method != http.MethodGet && method != http.MethodHead {
+		return localResponse(ctx, method, rawurl, http.StatusMethodNotAllowed, header, nil, 0)
+	}
+	name := filepath.FromSlash(u.Path)
+	file, err := os.Open(name)
+	switch {
+	case os.IsNotExist(err):
+		return localResponse(ctx, method, rawurl, http.StatusNotFound, header, nil, 0)
+	case os.IsPermission(err):
+		return localResponse(ctx, method, rawurl, http.StatusForbidden, header, nil, 0)
+	case err != nil:
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	if info.IsDir() {
+		file.Close()
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		var list bytes.Buffer
+		fmt.Fprintf(&list, "<!doctype html>\n<title>%s</title>\n<ul>\n", html.EscapeString(name))
+		for _, e := range entries {
+			link := e.Name()
+			if e.IsDir() {
+				link += "/"
+			}
+			ref := (&url.URL{Path: link}).String()
+			fmt.Fprintf(&list, "<li><a href=\"%s\">%s</a>\n", html.EscapeString(ref), html.EscapeString(link))
+		}
+		fmt.Fprintf(&list, "</ul>\n")
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		return localResponse(ctx, method, rawurl, http.StatusOK, header, io.NopCloser(&list), int64(list.Len()))
+	}
+
+	// the type from the extension, or else from the first bytes, like http.FileServer
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		contentType = http.DetectContentType(head[:n])
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	return localResponse(ctx, method, rawurl, http.StatusOK, header, file, info.Size())
+}
+
+// dataScheme serves RFC 2397 urls, which carry their content themselves:
+//	data:[<mediatype>][;base64],<data>
+// e.g. data:,Hello%2C%20World%21 or data:text/plain;base64,SGVsbG8sIFdvcmxkIQ==
+type dataScheme struct{}
+
+// normalize checks the syntax, and only drops the surrounding space: the url is its own content
+func (dataScheme) normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if _, _, err := parseDataURL(raw); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+func (dataScheme) roundTrip(ctx context.Context, method, rawurl string, body []byte) (*http.Response, error) {
+	if method != http.MethodGet && method != http.MethodHead {
+		return localResponse(ctx, method, rawurl, http.StatusMethodNotAllowed, make(http.Header), nil, 0)
+	}
+	mediaType, data, err := parseDataURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {mediaType}, "Content-Length": {strconv.Itoa(len(data))}}
+	return localResponse(ctx, method, rawurl, http.StatusOK, header, io.NopCloser(bytes.NewReader(data)), int64(len(data)))
+}
+
+// parseDataURL splits a data: url into its media type (text/plain;charset=US-ASCII if it has none) and its data
+func parseDataURL(raw string) (mediaType string, data []byte, err error) {
+	scheme, rest, _ := strings.Cut(raw, ":")
+	if !strings.EqualFold(scheme, "data") {
+		return "", nil, fmt.Errorf("not a data url: %q", raw)
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, fmt.Errorf("data url without a comma: %.40q", raw)
+	}
+	base64Encoded := false
+	if m, ok := strings.CutSuffix(meta, ";base64"); ok {
+		meta, base64Encoded = m, true
+	}
+	mediaType = meta
+	if mediaType == "" || strings.HasPrefix(mediaType, ";") {
+		// only parameters, such as ";charset=utf-8": the type defaults to text/plain
+		mediaType = "text/plain" + mediaType
+		if meta == "" {
+			mediaType += ";charset=US-ASCII"
+		}
+	}
+	if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+		return "", nil, fmt.Errorf("data url with a bad media type %q: %v", mediaType, err)
+	}
+	text, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("data url: %v", err)
+	}
+	if !base64Encoded {
+		return mediaType, []byte(text), nil
+	}
+	// padding is often left out; whitespace may be there for line breaks
+	text = strings.Join(strings.Fields(text), "")
+	data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+	if err != nil {
+		return "", nil, fmt.Errorf("data url: bad base64: %v", err)
+	}
+	return mediaType, data, nil
+}
+
+// hostOf returns the host (with port) a url points at, which is the key for per-host limits
+func hostOf(rawurl string) string {
+	normalized, err := normalizeURL(rawurl)
+	if err != nil {
+		// an invalid url fails inside fetch anyway; give it a bucket of its own
+		return rawurl
+	}
+	u, _ := url.Parse(normalized)
+	return u.Host
+}
+
+// poolStats counts jobs as they move from queued (read from the list) -> in-flight -> completed
+type poolStats struct {
+	mu        sync.Mutex
+	queued    int
+	inFlight  int
+	peak      int
+	completed int
+}
+
+func (s *poolStats) queue() {
+	s.mu.Lock()
+	s.queued++
+	s.mu.Unlock()
+}
+
+func (s *poolStats) start() {
+	s.mu.Lock()
+	s.queued--
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	s.mu.Unlock()
+}
+
+func (s *poolStats) finish() {
+	s.mu.Lock()
+	s.inFlight--
+	s.completed++
+	s.mu.Unlock()
+}
+
+func (s *poolStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("queued: %d, in-flight: %d (peak %d), completed: %d", s.queued, s.inFlight, s.peak, s.completed)
+}
+
+// hostLimiter hands out at most n slots per host;
+// each host gets its own buffered【channel】used as a counting semaphore
+type hostLimiter struct {
+	n     int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+	freed chan struct{} // signaled on every release, for dispatch
+}
+
+func newHostLimiter(n int) *hostLimiter {
+	return &hostLimiter{n: n, slots: make(map[string]chan struct{}), freed: make(chan struct{}, 1)}
+}
+
+func (l *hostLimiter) sem(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.slots[host]
+	if !ok {
+		sem = make(chan struct{}, l.n)
+		l.slots[host] = sem
+	}
+	return sem
+}
+
+// acquire blocks until host has a free slot
+func (l *hostLimiter) acquire(host string) {
+	if l.n <= 0 {
+		return
+	}
+	l.sem(host) <- struct{}{}
+}
+
+// tryAcquire takes a slot of host if there is a free one, without blocking
+func (l *hostLimiter) tryAcquire(host string) bool {
+	if l.n <= 0 {
+		return true
+	}
+	select {
+	case l.sem(host) <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *hostLimiter) release(host string) {
+	if l.n <= 0 {
+		return
+	}
+	<-l.sem(host)
+	select {
+	case l.freed <- struct{}{}:
+	default:
+		// one signal pending is enough
+	}
+}
+
+// bodySaver streams response bodies into -o dir, one file per url
+type bodySaver struct {
+	dir string
+
+	mu       sync.Mutex
+	taken    map[string]bool          // file names handed out during this run
+	manifest []manifestEntry          // the files saved during this run
+	saved    map[string]int           // url -> its entry in manifest
+	earlier  map[string]manifestEntry // url -> its entry in the manifest.json of an earlier run
+}
+
+// manifestEntry is one line of dir/manifest.json
+type manifestEntry struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+
+	resumed int64 // bytes that were already on disk, left by an earlier run
+	chunks  int   // number of Range requests the body was split into
+}
+
+func newBodySaver(dir string) (*bodySaver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &bodySaver{dir: dir, taken: make(map[string]bool), saved: make(map[string]int), earlier: make(map[string]manifestEntry)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	var entries []manifestEntry
+	if err == nil {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading the manifest of an earlier run: %v", err)
+	}
+	for _, entry := range entries {
+		s.earlier[entry.URL] = entry
+	}
+	return s, nil
+}
+
+// save streams resp.Body into dir/.fetch-<key>.part, then renames it to its final name,
+// so that a half-written body never shows up under a real name.
+// part is what an earlier run left of the url (with -resume), and resp the answer to its Range request;
+// a large 200 may be split into -chunks parallel Range requests.
+func (s *bodySaver) save(ctx context.Context, rawurl string, resp *http.Response, part *partMeta) (manifestEntry, error) {
+	entry := manifestEntry{URL: rawurl}
+	s.mu.Lock()
+	i, done := s.saved[rawurl]
+	if done {
+		entry.Path = s.manifest[i].Path
+	}
+	s.mu.Unlock()
+	if done {
+		// the other pass of -mode both has saved it: count and hash this body, but keep the file
+		hash := sha256.New()
+		n, err := io.Copy(hash, resp.Body)
+		entry.Bytes, entry.SHA256 = n, hex.EncodeToString(hash.Sum(nil))
+		return entry, err
+	}
+	partPath := s.partPath(rawurl)
+
+	var meta *partMeta
+	first := 0 // the chunk resp.Body carries
+	if part != nil && resp.StatusCode == http.StatusPartialContent {
+		first = part.next()
+		c := part.Chunks[first]
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != c.Start+c.Done || total != part.Length {
+			s.dropPartial(rawurl)
+			return entry, fmt.Errorf("the answer to Range: %s doesn't fit the partial download (Content-Range %q)",
+				c.rangeSpec(), resp.Header.Get("Content-Range"))
+		}
+		meta = part
+		for _, c := range meta.Chunks {
+			entry.resumed += c.Done
+		}
+	} else {
+		// a 200: the body changed (If-Range) or this is a fresh download
+		meta = newPartMeta(rawurl, resp)
+	}
+	entry.chunks = len(meta.Chunks)
+
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return entry, err
+	}
+	if entry.resumed == 0 {
+		file.Truncate(0)
+	}
+	keep := *resume && meta.validator() != ""
+	if keep {
+		meta.write(partPath)
+	}
+
+	var bar *progressBar
+	if board != nil {
+		bar = board.add(meta.Name, meta.Length, entry.resumed)
+	}
+
+	// resp.Body fills chunk first; every other unfinished chunk gets a Range request of its own
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		errMu.Unlock()
+	}
+	for i := range meta.Chunks {
+		c := &meta.Chunks[i]
+		if i == first || c.remaining() == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fetchChunk(ctx, rawurl, resp.Request.Header, meta, c, chunkWriter(file, c, bar)); err != nil {
+				fail(err)
+			}
+		}()
+	}
+	if err := copyChunk(chunkWriter(file, &meta.Chunks[first], bar), resp.Body, &meta.Chunks[first]); err != nil {
+		fail(err)
+	}
+	wg.Wait()
+	if closeErr := file.Close(); firstErr == nil {
+		firstErr = closeErr
+	}
+	if bar != nil {
+		bar.finish(firstErr)
+	}
+	if firstErr != nil {
+		if keep {
+			// the next run with -resume takes it from here
+			meta.write(partPath)
+		} else {
+			s.dropPartial(rawurl)
+		}
+		return entry, firstErr
+	}
+
+	// the chunks were written out of order: hash the file as a whole
+	entry.Bytes, entry.SHA256, err = hashFile(partPath)
+	if err == nil && meta.Length >= 0 && entry.Bytes != meta.Length {
+		err = fmt.Errorf("got %d bytes, Content-Length said %d", entry.Bytes, meta.Length)
+	}
+	if err != nil {
+		s.dropPartial(rawurl)
+		return entry, err
+	}
+
+	name := s.reserve(rawurl, meta.Name)
+	entry.Path = filepath.Join(s.dir, name)
+	// an existing file is one an earlier run saved for this very url: it is replaced
+	if err := os.Rename(partPath, entry.Path); err != nil {
+		s.dropPartial(rawurl)
+		return entry, err
+	}
+	os.Remove(partPath + ".json")
+
+	s.mu.Lock()
+	s.saved[rawurl] = len(s.manifest)
+	s.manifest = append(s.manifest, entry)
+	s.mu.Unlock()
+	return entry, nil
+}
+
+// reserve returns name, or name-1 / name-2 ... (before the extension)
+// if a file of that name already exists or was handed out earlier in this run.
+// The file an earlier run saved rawurl into is reused, if it is one of those names.
+func (s *bodySaver) reserve(rawurl, name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if entry, ok := s.earlier[rawurl]; ok {
+		old := filepath.Base(entry.Path)
+		n := strings.TrimSuffix(strings.TrimPrefix(old, stem+"-"), ext)
+		if _, err := strconv.Atoi(n); !s.taken[old] && (old == name || err == nil && old == stem+"-"+n+ext) {
+			s.taken[old] = true
+			return old
+		}
+	}
+	candidate := name
+	for n := 1; ; n++ {
+		if !s.taken[candidate] {
+			if _, err := os.Lstat(filepath.Join(s.dir, candidate)); os.IsNotExist(err) {
+				s.taken[candidate] = true
+				return candidate
+			}
+		}
+		candidate = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+}
+
+// writeManifest writes dir/manifest.json, atomically like the bodies themselves:
+// the files of this run, then those of earlier runs that are still there
+func (s *bodySaver) writeManifest() error {
+	s.mu.Lock()
+	entries := append([]manifestEntry(nil), s.manifest...)
+	var urls []string
+	for url := range s.earlier {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	for _, url := range urls {
+		entry := s.earlier[url]
+		old := filepath.Base(entry.Path)
+		if _, ok := s.saved[url]; ok || s.taken[old] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(s.dir, old)); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	s.mu.Unlock()
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".manifest-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Chmod(0644)
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, "manifest.json"))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// fileNameFor picks a file name for a response:
+// the filename parameter of Content-Disposition if the server sent one,
+// otherwise the last segment of the url path ("index.html" for a directory).
+func fileNameFor(resp *http.Response) string {
+	name := ""
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		//【mime.ParseMediaType】also decodes the RFC 2231 form: filename*=UTF-8''...
+		if _, params, err := mime.ParseMediaType(cd); err == nil {
+			name = params["filename"]
+		}
+	}
+	if name == "" {
+		name = path.Base(resp.Request.URL.Path)
+	}
+	return sanitizeFileName(name)
+}
+
+// sanitizeFileName keeps a server-supplied name inside the output directory:
+// no path separators, no hidden / special names, no control characters, bounded length.
+func sanitizeFileName(name string) string {
+	// a server may send "../../etc/passwd" or "C:\evil"; keep the last element only
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "index.html"
+	}
+	if len(name) > 200 {
+		ext := filepath.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:200-len(ext)], "") + ext
+	}
+	return name
+}
+
+// partMeta describes a download in progress; with -resume it is kept next to the body as
+//	dir/.fetch-<key>.part		the body so far, every byte at its final offset
+//	dir/.fetch-<key>.part.json	this, so that the next run knows what is missing
+// where key is derived from the url.
+type partMeta struct {
+	URL          string      `json:"url"`
+	Name         string      `json:"name"` // the file name, taken from the first response
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Length       int64       `json:"length"` // Content-Length, -1 if unknown
+	Chunks       []chunkSpan `json:"chunks"`
+}
+
+// chunkSpan is the byte range [Start, End) of the body, of which Done bytes are on disk
+type chunkSpan struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // -1: up to the end of a body of unknown length
+	Done  int64 `json:"done"`
+}
+
+// a body is split into chunks only if each of them gets at least this many bytes
+const minChunkSize = 1 << 20
+
+// newPartMeta plans the download of a 200: -chunks parallel ranges if the server takes Range requests
+// (Accept-Ranges, a known length and a validator to pin the body down), a single one otherwise.
+func newPartMeta(rawurl string, resp *http.Response) *partMeta {
+	meta := &partMeta{
+		URL:          rawurl,
+		Name:         fileNameFor(resp),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Length:       resp.ContentLength,
+	}
+	n := 1
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "bytes" && meta.validator() != "" {
+		n = min(*chunks, int(meta.Length/minChunkSize))
+	}
+	if n <= 1 {
+		meta.Chunks = []chunkSpan{{Start: 0, End: meta.Length}}
+		return meta
+	}
+	size := meta.Length / int64(n)
+	for i := 0; i < n; i++ {
+		c := chunkSpan{Start: int64(i) * size, End: int64(i+1) * size}
+		if i == n-1 {
+			c.End = meta.Length
+		}
+		meta.Chunks = append(meta.Chunks, c)
+	}
+	return meta
+}
+
+// validator is what If-Range may carry: a strong ETag, or else Last-Modified ("" if neither)
+func (meta *partMeta) validator() string {
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		return meta.ETag
+	}
+	return meta.LastModified
+}
+
+// next is the index of the first chunk that isn't complete, -1 if there is none
+func (meta *partMeta) next() int {
+	for i, c := range meta.Chunks {
+		if c.remaining() != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// resume asks for the rest of the first unfinished chunk, on condition that the body is still the same;
+// if it changed, If-Range makes the server send all of it with a 200
+func (meta *partMeta) resume(header http.Header) {
+	header.Set("Range", meta.Chunks[meta.next()].rangeSpec())
+	header.Set("If-Range", meta.validator())
+}
+
+func (meta *partMeta) write(partPath string) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partPath+".json", data, 0644)
+}
+
+// remaining is how many bytes of c are still missing, -1 if that isn't known
+func (c chunkSpan) remaining() int64 {
+	if c.End < 0 {
+		return -1
+	}
+	return c.End - c.Start - c.Done
+}
+
+// rangeSpec is the value of a Range header asking for the rest of c
+func (c chunkSpan) rangeSpec() string {
+	if c.End < 0 {
+		return fmt.Sprintf("bytes=%d-", c.Start+c.Done)
+	}
+	return fmt.Sprintf("bytes=%d-%d", c.Start+c.Done, c.End-1)
+}
+
+func (s *bodySaver) partPath(rawurl string) string {
+	sum := sha256.Sum256([]byte(rawurl))
+	return filepath.Join(s.dir, ".fetch-"+hex.EncodeToString(sum[:8])+".part")
+}
+
+// partial returns what an earlier run left of rawurl, or nil if there is nothing worth resuming
+func (s *bodySaver) partial(rawurl string) *partMeta {
+	partPath := s.partPath(rawurl)
+	data, err := os.ReadFile(partPath + ".json")
+	if err != nil {
+		return nil
+	}
+	var meta partMeta
+	if json.Unmarshal(data, &meta) != nil || meta.URL != rawurl || meta.validator() == "" || len(meta.Chunks) == 0 {
+		return nil
+	}
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return nil
+	}
+	if len(meta.Chunks) == 1 {
+		// written front to back: the file knows better than a .json saved when the download started
+		c := &meta.Chunks[0]
+		c.Done = info.Size()
+		if c.End >= 0 && c.Done > c.End {
+			c.Done = c.End
+		}
+	}
+	if meta.next() < 0 || (len(meta.Chunks) == 1 && meta.Chunks[0].Done == 0) {
+		// nothing is missing (it stopped right before the rename), or nothing is there: start over
+		return nil
+	}
+	return &meta
+}
+
+// dropPartial removes whatever is left of a download of rawurl
+func (s *bodySaver) dropPartial(rawurl string) {
+	os.Remove(s.partPath(rawurl))
+	os.Remove(s.partPath(rawurl) + ".json")
+}
+
+// parseContentRange reads "bytes first-last/total" (total: -1 for "*")
+func parseContentRange(value string) (start, total int64, err error) {
+	var last int64
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%d", &start, &last, &total); err == nil {
+		return start, total, nil
+	}
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/*", &start, &last); err == nil {
+		return start, -1, nil
+	}
+	return 0, 0, fmt.Errorf("bad Content-Range %q", value)
+}
+
+// fetchChunk asks for the rest of chunk c with a Range request, and writes it to w.
+// It carries the header fields of the request the body came from (-H, credentials), as that request had them.
+func fetchChunk(ctx context.Context, rawurl string, base http.Header, meta *partMeta, c *chunkSpan, w io.Writer) error {
+	header := base.Clone()
+	for _, key := range []string{"If-None-Match", "If-Modified-Since", "Accept-Encoding"} {
+		header.Del(key)
+	}
+	header.Set("Range", c.rangeSpec())
+	header.Set("If-Range", meta.validator())
+	var phases phaseTimings
+	resp, cancel, _, err := send(ctx, http.MethodGet, rawurl, nil, header, &phases)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	idleTimeout(resp)
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Range: %s got %d %s instead of 206 (the body changed?)",
+			c.rangeSpec(), resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != c.Start+c.Done || total != meta.Length {
+		return fmt.Errorf("Range: %s got Content-Range %q", c.rangeSpec(), resp.Header.Get("Content-Range"))
+	}
+	return copyChunk(w, resp.Body, c)
+}
+
+// copyChunk copies the rest of chunk c from body: up to c.End, or to EOF if the end isn't known.
+// A body that stops short is an error.
+func copyChunk(w io.Writer, body io.Reader, c *chunkSpan) error {
+	want := c.remaining()
+	if want < 0 {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(body, want))
+	if err == nil && n < want {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// chunkWriter writes at the current end of chunk c in file, counting into c.Done (and bar)
+func chunkWriter(file *os.File, c *chunkSpan, bar *progressBar) io.Writer {
+	return &spanWriter{w: io.NewOffsetWriter(file, c.Start+c.Done), done: &c.Done, bar: bar}
+}
+
+type spanWriter struct {
+	w    io.Writer
+	done *int64
+	bar  *progressBar
+}
+
+func (sw *spanWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	// the only writer of *done while the download runs; it is read once all writers are done
+	*sw.done += int64(n)
+	if sw.bar != nil {
+		sw.bar.add(n)
+	}
+	return n, err
+}
+
+// hashFile returns the size and hex SHA-256 digest of a file
+func hashFile(name string) (int64, string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	return n, hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// board is set when -progress is given
+var board *progressBoard
+
+// progressBoard draws a progress bar per running download on stderr, redrawn in place on a terminal;
+// a finished bar is drawn one last time and left behind, above the running ones.
+// Anything else is only printed once, when the download ends.
+type progressBoard struct {
+	w       io.Writer
+	tty     bool
+	done    chan struct{} // closed by stop
+	stopped chan struct{} // closed by run, once the last drawing is out
+
+	mu    sync.Mutex
+	bars  []*progressBar
+	drawn int // lines of running bars on screen
+}
+
+type progressBar struct {
+	name  string
+	total int64 // -1 if unknown
+	start time.Time
+	from  int64 // bytes already there when it started (resumed)
+	bytes atomic.Int64
+	ended atomic.Bool
+	err   error
+}
+
+func newProgressBoard(w *os.File) *progressBoard {
+	info, err := w.Stat()
+	tty := err == nil && info.Mode()&os.ModeCharDevice != 0
+	return &progressBoard{w: w, tty: tty, done: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+func (b *progressBoard) add(name string, total, from int64) *progressBar {
+	bar := &progressBar{name: name, total: total, start: time.Now(), from: from}
+	bar.bytes.Store(from)
+	b.mu.Lock()
+	b.bars = append(b.bars, bar)
+	b.mu.Unlock()
+	return bar
+}
+
+// run redraws the board every 200ms until stop
+func (b *progressBoard) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.draw()
+		case <-b.done:
+			b.draw()
+			return
+		}
+	}
+}
+
+// stop draws the board one last time
+func (b *progressBoard) stop() {
+	close(b.done)
+	<-b.stopped
+}
+
+func (b *progressBoard) draw() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.erase()
+	running := b.bars[:0]
+	for _, bar := range b.bars {
+		ended := bar.ended.Load()
+		if b.tty || ended {
+			fmt.Fprintln(b.w, bar)
+		}
+		if !ended {
+			running = append(running, bar)
+		}
+	}
+	b.bars = running
+	b.drawn = 0
+	if b.tty {
+		b.drawn = len(running)
+	}
+}
+
+// erase removes the running bars from the screen: back to their first line, and clear from there down
+func (b *progressBoard) erase() {
+	if b.tty && b.drawn > 0 {
+		fmt.Fprintf(b.w, "\x1b[%dF\x1b[J", b.drawn)
+		b.drawn = 0
+	}
+}
+
+// above wraps w (stdout, say) so that what is written to it goes above the running bars
+// instead of through them; the next drawing puts the bars back below
+func (b *progressBoard) above(w io.Writer) io.Writer {
+	return &boardWriter{board: b, w: w}
+}
+
+type boardWriter struct {
+	board *progressBoard
+	w     io.Writer
+}
+
+func (bw *boardWriter) Write(p []byte) (int, error) {
+	bw.board.mu.Lock()
+	defer bw.board.mu.Unlock()
+	bw.board.erase()
+	return bw.w.Write(p)
+}
+
+func (bar *progressBar) add(n int) {
+	bar.bytes.Add(int64(n))
+}
+
+func (bar *progressBar) finish(err error) {
+	bar.err = err
+	bar.ended.Store(true)
+}
+
+// String draws the bar:
+//	app.tar.gz  [=========>          ]  48%   12.0 MiB / 25.0 MiB   3.1 MiB/s
+func (bar *progressBar) String() string {
+	const width = 20
+	n := bar.bytes.Load()
+	rate := float64(n-bar.from) / time.Since(bar.start).Seconds()
+	name := bar.name
+	if len(name) > 24 {
+		name = name[:21] + "..."
+	}
+	var line string
+	if bar.total > 0 {
+		filled := int(int64(width) * n / bar.total)
+		arrow := strings.Repeat("=", filled)
+		if filled < width {
+			arrow += ">" + strings.Repeat(" ", width-filled-1)
+		}
+		line = fmt.Sprintf("%-24s [%s] %3d%% %10s / %s %10s/s", name, arrow, 100*n/bar.total, byteSize(n), byteSize(bar.total), byteSize(int64(rate)))
+	} else {
+		line = fmt.Sprintf("%-24s %10s %10s/s", name, byteSize(n), byteSize(int64(rate)))
+	}
+	if bar.ended.Load() && bar.err != nil {
+		line += fmt.Sprintf("  failed: %v", bar.err)
+	}
+	return line
+}
+
+// byteSize formats n as B / KiB / MiB / GiB
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// httpCache keeps bodies on disk under -cache dir, together with their validators,
+// so that the next run can ask "has it changed?" (If-None-Match / If-Modified-Since)
+// and take the body from disk when the answer is 304 Not Modified.
+//	dir/<sha256 of url>.body	the body as it was last downloaded
+//	dir/<sha256 of url>.json	a cacheMeta
+type httpCache struct {
+	dir string
+
+	mu        sync.Mutex
+	hits      int // 304s answered from disk
+	downloads int // everything else
+}
+
+// cacheMeta is what we remember about a stored body
+type cacheMeta struct {
+	URL                string    `json:"url"`
+	ETag               string    `json:"etag,omitempty"`
+	LastModified       string    `json:"last_modified,omitempty"`
+	ContentType        string    `json:"content_type,omitempty"`
+	ContentDisposition string    `json:"content_disposition,omitempty"`
+	Bytes              int64     `json:"bytes"`
+	Stored             time.Time `json:"stored"`
+}
+
+func newHTTPCache(dir string) (*httpCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &httpCache{dir: dir}, nil
+}
+
+// key maps a url onto a safe file name
+func (c *httpCache) key(rawurl string) string {
+	sum := sha256.Sum256([]byte(rawurl))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// lookup returns the stored metadata for rawurl, or nil if there is nothing usable
+func (c *httpCache) lookup(rawurl string) *cacheMeta {
+	data, err := os.ReadFile(c.key(rawurl) + ".json")
+	if err != nil {
+		return nil
+	}
+	var meta cacheMeta
+	if json.Unmarshal(data, &meta) != nil || meta.URL != rawurl {
+		return nil
+	}
+	if _, err := os.Stat(c.key(rawurl) + ".body"); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+// conditional adds the validators of meta to a request's header
+func (meta *cacheMeta) conditional(header http.Header) {
+	if meta.ETag != "" {
+		header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		header.Set("If-Modified-Since", meta.LastModified)
+	}
+}
+
+// hit swaps the (empty) body of a 304 for the stored one
+func (c *httpCache) hit(meta *cacheMeta, resp *http.Response) error {
+	body, err := os.Open(c.key(meta.URL) + ".body")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	resp.Body = body
+	// the length of the stored body, not of the 304's empty one: the saver (-o) plans and checks its copy by it
+	resp.ContentLength = meta.Bytes
+	// a 304 may leave these out; the saver (-o) wants them
+	if resp.Header.Get("Content-Type") == "" && meta.ContentType != "" {
+		resp.Header.Set("Content-Type", meta.ContentType)
+	}
+	if resp.Header.Get("Content-Disposition") == "" && meta.ContentDisposition != "" {
+		resp.Header.Set("Content-Disposition", meta.ContentDisposition)
+	}
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return nil
+}
+
+// fill arranges for resp.Body to be copied into the cache while the caller reads it.
+// Only 200s carrying a validator are worth keeping: without one they can't be revalidated.
+func (c *httpCache) fill(rawurl string, resp *http.Response) {
+	c.mu.Lock()
+	c.downloads++
+	c.mu.Unlock()
+
+	meta := cacheMeta{
+		URL:                rawurl,
+		ETag:               resp.Header.Get("ETag"),
+		LastModified:       resp.Header.Get("Last-Modified"),
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+	}
+	if resp.StatusCode != http.StatusOK || (meta.ETag == "" && meta.LastModified == "") ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		return
+	}
+	tmp, err := os.CreateTemp(c.dir, ".cache-*.tmp")
+	if err != nil {
+		return
+	}
+	resp.Body = &cacheFiller{ReadCloser: resp.Body, cache: c, meta: meta, tmp: tmp}
+}
+
+// cacheFiller is a tee: what is read from the body is also written to tmp.
+// On Close, a body that was read to the end is moved into the cache; anything else is thrown away.
+type cacheFiller struct {
+	io.ReadCloser
+	cache *httpCache
+	meta  cacheMeta
+	tmp   *os.File
+	eof   bool
+	err   error
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if n > 0 && f.err == nil {
+		_, f.err = f.tmp.Write(p[:n])
+		f.meta.Bytes += int64(n)
+	}
+	if err == io.EOF {
+		f.eof = true
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	err := f.ReadCloser.Close()
+	if closeErr := f.tmp.Close(); f.err == nil {
+		f.err = closeErr
+	}
+	if !f.eof || f.err != nil || f.cache.commit(f.tmp.Name(), f.meta) != nil {
+		os.Remove(f.tmp.Name())
+	}
+	return err
+}
+
+// commit moves a complete body into place, then writes its metadata
+func (c *httpCache) commit(tmpName string, meta cacheMeta) error {
+	meta.Stored = time.Now()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	key := c.key(meta.URL)
+	if err := os.Rename(tmpName, key+".body"); err != nil {
+		return err
+	}
+	return os.WriteFile(key+".json", data, 0644)
+}
+
+func (c *httpCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("cache: %d hit(s) (304 cached), %d download(s)", c.hits, c.downloads)
+}
+
+// phaseTimings breaks ONE attempt down into the phases reported by【net/http/httptrace】.
+// A phase that didn't happen (no DNS for an IP literal, no TLS for http://,
+// nothing at all on a reused keep-alive connection) stays 0.
+type phaseTimings struct {
+	DNS     time.Duration // DNSStart -> DNSDone
+	Connect time.Duration // ConnectStart -> ConnectDone (TCP)
+	TLS     time.Duration // TLSHandshakeStart -> TLSHandshakeDone
+	Sent    time.Duration // asking for a connection -> the request written
+	TTFB    time.Duration // asking for a connection -> the first response byte
+	Reused  bool          // the connection came from the keep-alive pool
+}
+
+// withTrace returns a ctx that records the phases of a request, and the function that hands them out
+// once the request is over; after that, a callback still running (a dial that lost the race) records nothing
+func withTrace(ctx context.Context) (context.Context, func() phaseTimings) {
+	// with "happy eyeballs" several dials may race, so the callbacks can run concurrently:
+	// everything below is guarded by mu
+	var (
+		mu                                      sync.Mutex
+		t                                       phaseTimings
+		done                                    bool
+		start, dnsStart, connectStart, tlsStart time.Time
+	)
+	mark := func(at *time.Time) {
+		mu.Lock()
+		*at = time.Now()
+		mu.Unlock()
+	}
+	record := func(phase *time.Duration, from *time.Time) {
+		mu.Lock()
+		if !done {
+			*phase = time.Since(*from)
+		}
+		mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { mark(&start) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			if !done {
+				t.Reused = info.Reused
+			}
+			mu.Unlock()
+		},
+		DNSStart:     func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { record(&t.DNS, &dnsStart) },
+		ConnectStart: func(network, addr string) { mark(&connectStart) },
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				record(&t.Connect, &connectStart)
+			}
+		},
+		TLSHandshakeStart:    func() { mark(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(&t.TLS, &tlsStart) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { record(&t.Sent, &start) },
+		GotFirstResponseByte: func() { record(&t.TTFB, &start) },
+	}
+	timings := func() phaseTimings {
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		if t.Reused {
+			// a dial may have raced for a pooled connection and lost: its phases are not this request's
+			t.DNS, t.Connect, t.TLS = 0, 0, 0
+		}
+		return t
+	}
+	return httptrace.WithClientTrace(ctx, trace), timings
+}
+
+func (t phaseTimings) String() string {
+	reused := ""
+	if t.Reused {
+		reused = " (reused connection)"
+	}
+	return fmt.Sprintf("dns %s, connect %s, tls %s, ttfb %s%s", ms(t.DNS), ms(t.Connect), ms(t.TLS), ms(t.TTFB), reused)
+}
+
+// ms formats a duration as milliseconds with 2 decimals
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.2fms", d.Seconds()*1000)
+}
+
+// phaseSummary aggregates phaseTimings across a run: how often each phase happened, its average and maximum
+type phaseSummary struct {
+	names [4]string
+	count [4]int
+	sum   [4]time.Duration
+	max   [4]time.Duration
+}
+
+func newPhaseSummary() *phaseSummary {
+	return &phaseSummary{names: [4]string{"dns", "connect", "tls", "ttfb"}}
+}
+
+func (s *phaseSummary) add(r fetchResult) {
+	if r.Status == 0 {
+		// no response, so no complete trace either
+		return
+	}
+	for i, d := range [4]time.Duration{r.Phases.DNS, r.Phases.Connect, r.Phases.TLS, r.Phases.TTFB} {
+		if d <= 0 {
+			continue
+		}
+		s.count[i]++
+		s.sum[i] += d
+		if d > s.max[i] {
+			s.max[i] = d
+		}
+	}
+}
+
+func (s *phaseSummary) String() string {
+	var parts []string
+	for i, name := range s.names {
+		if s.count[i] == 0 {
+			parts = append(parts, name+" -")
+			continue
+		}
+		avg := s.sum[i] / time.Duration(s.count[i])
+		parts = append(parts, fmt.Sprintf("%s avg %s max %s (n=%d)", name, ms(avg), ms(s.max[i]), s.count[i]))
+	}
+	return "phases: " + strings.Join(parts, ", ")
+}
+
+// decodeBody undoes the Content-Encoding of resp.Body, which was asked for with "Accept-Encoding: gzip, deflate"
+// (so the transport left it alone); resp.Body then reads the decoded body, and wire counts the bytes as received.
+// An encoding other than gzip / deflate is left in place: supported is false.
+func decodeBody(resp *http.Response) (wire *countingReader, encoding string, supported bool, err error) {
+	wire = &countingReader{r: resp.Body}
+	body := resp.Body
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{wire, body}
+
+	encoding = strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		// no body to decode
+		return wire, encoding, true, nil
+	}
+	var decoded io.Reader
+	switch encoding {
+	case "", "identity":
+		return wire, "identity", true, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(wire)
+		if err == io.EOF {
+			// an empty body, even though it claims to be gzipped
+			return wire, encoding, true, nil
+		}
+		if err != nil {
+			return wire, encoding, true, err
+		}
+		decoded = zr
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped (RFC 9110), but some servers send raw deflate
+		br := bufio.NewReader(wire)
+		if head, err := br.Peek(2); err == nil && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return wire, encoding, true, err
+			}
+			decoded = zr
+		} else {
+			decoded = flate.NewReader(br)
+		}
+	default:
+		// br, zstd, a list of codings ...: passed on as is
+		return wire, encoding, false, nil
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{decoded, body}
+	// the Content-Length was that of the encoded body
+	resp.ContentLength = -1
+	return wire, encoding, true, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// encodingText describes the Content-Encoding of a body and what it saved
+func (r fetchResult) encodingText() string {
+	switch {
+	case !r.EncodingSupported:
+		return fmt.Sprintf("%s (unsupported: left encoded, %d bytes)", r.Encoding, r.WireBytes)
+	case r.Encoding == "identity":
+		return "identity (not compressed)"
+	}
+	return fmt.Sprintf("%s, %d bytes on the wire -> %d decoded (%.2fx)", r.Encoding, r.WireBytes, r.Bytes, r.ratio())
+}
+
+// ratio is decoded / wire size: how much the Content-Encoding saved (1 for an uncompressed body)
+func (r fetchResult) ratio() float64 {
+	if r.WireBytes == 0 || !r.EncodingSupported {
+		return 0
+	}
+	return float64(r.Bytes) / float64(r.WireBytes)
+}
+
+// encodingSummary aggregates the Content-Encodings of a run, to spot the servers that don't compress
+type encodingSummary struct {
+	counts      map[string]int // per encoding, "identity" for none
+	unsupported int
+	wire        int64
+	decoded     int64
+}
+
+func newEncodingSummary() *encodingSummary {
+	return &encodingSummary{counts: make(map[string]int)}
+}
+
+func (s *encodingSummary) add(r fetchResult) {
+	if r.Encoding == "" || r.Kind != kindOK {
+		// compression wasn't asked for, or the body didn't arrive
+		return
+	}
+	s.counts[r.Encoding]++
+	if !r.EncodingSupported {
+		s.unsupported++
+		return
+	}
+	s.wire += r.WireBytes
+	s.decoded += r.Bytes
+}
+
+func (s *encodingSummary) String() string {
+	if len(s.counts) == 0 {
+		return "compression: -"
+	}
+	var names []string
+	for name := range s.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d", name, s.counts[name]))
+	}
+	line := fmt.Sprintf("compression: %s", strings.Join(parts, ", "))
+	if s.unsupported > 0 {
+		line += fmt.Sprintf(" (%d unsupported)", s.unsupported)
+	}
+	if s.wire > 0 {
+		line += fmt.Sprintf("; %s on the wire for %s decoded (%.2fx)", byteSize(s.wire), byteSize(s.decoded), float64(s.decoded)/float64(s.wire))
+	}
+	return line
+}
+
+// benchmark fetches every url -bench times, first one at a time, then with -workers in parallel,
+// and reports latency percentiles, a histogram, throughput and the error rate of each pass.
+// -o and -cache are ignored: every request goes over the network, and every body is discarded.
+func benchmark(ctx context.Context, urls []string, out *resultWriter) {
+	var repeated []string
+	for i := 0; i < *benchN; i++ {
+		repeated = append(repeated, urls...)
+	}
+
+	seq := benchPass(ctx, "sequential", 1, repeated)
+	seq.print(out)
+	if ctx.Err() != nil {
+		return
+	}
+	// -workers requests at a time, whatever the hosts: -per-host would cap a one-host load test
+	conc := benchPass(ctx, "concurrent", *workers, repeated)
+	conc.print(out)
+
+	// the same work, in less wall-clock time
+	if conc.Wall > 0 {
+		speedup := seq.Wall.Seconds() / conc.Wall.Seconds()
+		if out.format == "json" {
+			fmt.Fprintf(out.w, "{\"speedup\":%.3f}\n", speedup)
+		} else {
+			fmt.Fprintf(out.w, "speedup (sequential / concurrent wall time): %.2fx\n", speedup)
+		}
+	}
+}
+
+// benchStats is the outcome of one benchmark pass
+type benchStats struct {
+	Pass        string        `json:"pass"`
+	Concurrency int           `json:"concurrency"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"` // failed fetches and 4xx / 5xx answers
+	Wall        time.Duration `json:"wall_ns"`
+	P50         time.Duration `json:"p50_ns"`
+	P90         time.Duration `json:"p90_ns"`
+	P99         time.Duration `json:"p99_ns"`
+	Max         time.Duration `json:"max_ns"`
+
+	latencies []time.Duration // sorted
+}
+
+func benchPass(ctx context.Context, name string, concurrency int, urls []string) *benchStats {
+	stats := &benchStats{Pass: name, Concurrency: concurrency}
+	start := time.Now()
+	ch := make(chan fetchResult)
+	go runPool(ctx, concurrency, 0, listJobs(urls, false), ch, &poolStats{}, fetch)
+	for r := range ch {
+		stats.Requests++
+		if r.Kind != kindOK || r.Status >= 400 {
+			stats.Errors++
+		}
+		stats.latencies = append(stats.latencies, r.Elapsed)
+	}
+	stats.Wall = time.Since(start)
+
+	sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+	stats.P50 = percentile(stats.latencies, 50)
+	stats.P90 = percentile(stats.latencies, 90)
+	stats.P99 = percentile(stats.latencies, 99)
+	stats.Max = percentile(stats.latencies, 100)
+	return stats
+}
+
+// percentile uses the nearest-rank method on a sorted slice
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (s *benchStats) throughput() float64 {
+	if s.Wall <= 0 {
+		return 0
+	}
+	return float64(s.Requests) / s.Wall.Seconds()
+}
+
+func (s *benchStats) errorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+func (s *benchStats) print(out *resultWriter) {
+	if out.format == "json" {
+		data, _ := json.Marshal(struct {
+			*benchStats
+			Throughput float64 `json:"throughput_rps"`
+			ErrorRate  float64 `json:"error_rate"`
+		}{s, s.throughput(), s.errorRate()})
+		fmt.Fprintf(out.w, "%s\n", data)
+		return
+	}
+	fmt.Fprintf(out.w, "【%s】concurrency %d: %d requests in %.2fs, %.1f req/s, %d errors (%.1f%%)\n",
+		s.Pass, s.Concurrency, s.Requests, s.Wall.Seconds(), s.throughput(), s.Errors, 100*s.errorRate())
+	fmt.Fprintf(out.w, " latency: p50 %s, p90 %s, p99 %s, max %s\n", ms(s.P50), ms(s.P90), ms(s.P99), ms(s.Max))
+	s.histogram(out.w)
+	fmt.Fprintln(out.w)
+}
+
+// histogram draws the latencies in 10 equal-width buckets between the fastest and the slowest request
+func (s *benchStats) histogram(w io.Writer) {
+	const buckets, width = 10, 40
+	if len(s.latencies) == 0 {
+		return
+	}
+	low, high := s.latencies[0], s.latencies[len(s.latencies)-1]
+	step := (high - low) / buckets
+	if step <= 0 {
+		step = 1
+	}
+	var counts [buckets]int
+	for _, d := range s.latencies {
+		i := int((d - low) / step)
+		if i >= buckets {
+			i = buckets - 1
+		}
+		counts[i]++
+	}
+	most := 0
+	for _, n := range counts {
+		if n > most {
+			most = n
+		}
+	}
+	for i, n := range counts {
+		from := low + time.Duration(i)*step
+		bar := strings.Repeat("#", n*width/most)
+		fmt.Fprintf(w, " %10s - %-10s |%-*s %d\n", ms(from), ms(from+step), width, bar, n)
+	}
+}
+
+// crawlNode is a crawled page and the same-host pages it links to: a node of the site graph
+type crawlNode struct {
+	fetchResult
+	Depth int
+	Links []string
+}
+
+// crawl_fetch follows <a href> links from the starting urls, breadth-first,
+// up to -depth links away, without leaving the starting hosts.
+// Every page is fetched once, by the worker pool (runPool): at most -workers fetches (and -per-host per host)
+// run at a time. -o is ignored: the bodies are needed in memory to find their links.
+func crawl_fetch(ctx context.Context, seeds []string, out *resultWriter) {
+	start := time.Now()
+	// every crawled page reports its node, and so the next pages to visit, on this【channel】
+	worklist := make(chan crawlNode)
+	// the pages to crawl go to the pool one by one, as it takes them
+	jobs := make(chan job)
+	// nothing is sent on done: runPool closes it once every worker is done
+	done := make(chan fetchResult)
+
+	seen := make(map[string]bool)
+	allowed := make(map[string]bool) // the starting hosts
+	var queue []job                  // pages found, not handed to the pool yet, in the order they were found
+	var depths []int                 // by job idx: how many links away from a starting url
+	visit := func(url string, depth int) {
+		if seen[url] {
+			return
+		}
+		seen[url] = true
+		queue = append(queue, job{idx: len(depths), url: url})
+		depths = append(depths, depth)
+	}
+
+	// every starting host is allowed before the first page is crawled:
+	// from then on the workers read allowed, and nothing may write it any more
+	var starts []string
+	for _, seed := range seeds {
+		normalized, err := normalizeURL(seed)
+		if err != nil {
+			out.writeNode(crawlNode{fetchResult: fetchResult{URL: seed, Kind: kindInvalid, Err: err}})
+			continue
+		}
+		allowed[hostOf(normalized)] = true
+		starts = append(starts, normalized)
+	}
+	for _, page := range starts {
+		visit(page, 0)
+	}
+	go runPool(ctx, *workers, *perHost, jobs, done, &poolStats{},
+		func(ctx context.Context, j job, _ chan<- fetchResult) {
+			worklist <- crawlOne(ctx, j.idx, j.url, allowed)
+		})
+
+	pages, failed := 0, 0
+	pending := 0 // pages handed to the pool, their node not back yet
+	for running := true; running; {
+		if jobs != nil && ((pending == 0 && len(queue) == 0) || ctx.Err() != nil) {
+			// nothing more to crawl (or no time left): the pool winds down, and closes done
+			close(jobs)
+			jobs = nil
+		}
+		// a nil【channel】blocks forever: it turns its case of the select off
+		var next chan<- job
+		if jobs != nil && len(queue) > 0 {
+			next = jobs
+		}
+		var first job
+		if len(queue) > 0 {
+			first = queue[0]
+		}
+		select {
+		case next <- first:
+			queue = queue[1:]
+			pending++
+		case node := <-worklist:
+			pending--
+			node.Depth = depths[node.Index]
+			out.writeNode(node)
+			pages++
+			if (node.Kind != kindOK || node.Status >= 400) && node.Kind != kindSkipped {
+				failed++
+			}
+			if node.Depth < *crawlDepth && ctx.Err() == nil {
+				for _, link := range node.Links {
+					visit(link, node.Depth+1)
+				}
+			}
+		case <-done:
+			running = false
+		}
+	}
+
+	out.flush()
+	fmt.Fprintf(out.log, "crawled %d page(s) on %d host(s), %d failed, in %.2fs\n", pages, len(allowed), failed, time.Since(start).Seconds())
+}
+
+// crawlOne fetches a page and, if it's HTML from an allowed host, collects its same-host links
+func crawlOne(ctx context.Context, idx int, url string, allowed map[string]bool) crawlNode {
+	var body cappedBuffer
+	body.limit = maxPageSize
+	node := crawlNode{fetchResult: fetchURLTo(ctx, idx, request.get(), url, &body, nil)}
+	if node.Kind != kindOK || !isHTML(node.ContentType) || node.finalURL == nil {
+		return node
+	}
+	// a redirect may have taken us somewhere else
+	if !allowed[node.finalURL.Host] {
+		return node
+	}
+	linked := make(map[string]bool)
+	for _, l := range extractLinks(body.Bytes()) {
+		if l.Tag != "a" || l.Attr != "href" {
+			continue
+		}
+		target, ok := resolveLink(node.finalURL, l.Value)
+		if !ok || !allowed[hostOf(target)] || linked[target] {
+			continue
+		}
+		linked[target] = true
+		node.Links = append(node.Links, target)
+	}
+	return node
+}
+
+// the largest body we keep in memory to look for links in
+const maxPageSize = 8 << 20
+
+// cappedBuffer keeps the first limit bytes written to it and silently drops the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func isHTML(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// link is a url-valued attribute found in an HTML page
+type link struct {
+	Tag   string // lower-case tag name: a, img, script, link ...
+	Attr  string // href or src
+	Value string // as written, with HTML entities decoded
+	Line  int    // 1-based line of the page it appears on
+}
+
+// Without golang.org/x/net/html, a pair of regular expressions stands in for a real HTML parser:
+// tagPattern finds comments (to skip them) and start tags, attrPattern the href / src inside a tag.
+var (
+	tagPattern  = regexp.MustCompile(`(?s)<!--.*?-->|<([a-zA-Z][a-zA-Z0-9-]*)(\s[^>]*)?>`)
+	attrPattern = regexp.MustCompile(`(?i)(?:^|\s)(href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// extractLinks returns every href / src attribute of body, in document order
+func extractLinks(body []byte) []link {
+	var links []link
+	line, pos := 1, 0
+	for _, m := range tagPattern.FindAllSubmatchIndex(body, -1) {
+		if m[2] < 0 {
+			// a comment
+			continue
+		}
+		line += bytes.Count(body[pos:m[0]], []byte("\n"))
+		pos = m[0]
+		if m[4] < 0 {
+			continue
+		}
+		tag := strings.ToLower(string(body[m[2]:m[3]]))
+		attrs := body[m[4]:m[5]]
+		for _, a := range attrPattern.FindAllSubmatchIndex(attrs, -1) {
+			value := ""
+			for g := 4; g <= 8; g += 2 {
+				if a[g] >= 0 {
+					value = string(attrs[a[g]:a[g+1]])
+					break
+				}
+			}
+			links = append(links, link{
+				Tag:   tag,
+				Attr:  strings.ToLower(string(attrs[a[2]:a[3]])),
+				Value: html.UnescapeString(strings.TrimSpace(value)),
+				// an attribute may sit on a later line than its tag's "<"
+				Line: line + bytes.Count(body[m[0]:m[4]+a[0]], []byte("\n")),
+			})
+		}
+	}
+	return links
+}
+
+// resolveLink makes an href absolute against the page it was found on.
+// It reports false for links that can't be fetched (mailto:, javascript:, a bare #fragment ...).
+func resolveLink(base *url.URL, href string) (string, bool) {
+	if href == "" || strings.HasPrefix(href, "#") {
+		return "", false
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	target := base.ResolveReference(ref)
+	// a local page may link to local files, a web page may not
+	if !supportedSchemes[target.Scheme] && !(target.Scheme == "file" && base.Scheme == "file") {
+		return "", false
+	}
+	target.Fragment = ""
+	normalized, err := normalizeURL(target.String())
+	if err != nil {
+		return "", false
+	}
+	return normalized, true
+}
+
+// writeNode prints a crawled page and its edges in the -format of choice
+func (out *resultWriter) writeNode(n crawlNode) {
+	switch out.format {
+	case "json":
+		// fetchResult has its own MarshalJSON, which an embedded field would promote over the whole node
+		page, _ := json.Marshal(n.fetchResult)
+		data, _ := json.Marshal(struct {
+			Depth int             `json:"depth"`
+			Page  json.RawMessage `json:"page"`
+			Links []string        `json:"links"`
+		}{n.Depth, page, n.Links})
+		fmt.Fprintf(out.w, "%s\n", data)
+	case "csv":
+		// one row per edge; a page without links still gets one row, with an empty "link"
+		out.csvHeader([]string{"depth", "url", "kind", "status", "link"})
+		row := []string{strconv.Itoa(n.Depth), n.URL, n.Kind, strconv.Itoa(n.Status), ""}
+		if len(n.Links) == 0 {
+			out.csv.Write(row)
+		}
+		for _, l := range n.Links {
+			row[4] = l
+			out.csv.Write(row)
+		}
+	default:
+		if n.Kind != kindOK {
+			fmt.Fprintf(out.w, "【depth %d】%s (%s): %v\n", n.Depth, n.Kind, n.URL, n.Err)
+			return
+		}
+		fmt.Fprintf(out.w, "【depth %d】%d %s (%s) %d link(s)\n", n.Depth, n.Status, http.StatusText(n.Status), n.URL, len(n.Links))
+		for _, l := range n.Links {
+			fmt.Fprintf(out.w, "\t-> %s\n", l)
+		}
+	}
+}
+
+// linkUse is one appearance of a link on a page
+type linkUse struct {
+	Page string
+	link
+}
+
+// check_links fetches the given pages, extracts every href / src, and checks each target once
+// (HEAD first, GET if HEAD fails), reporting the broken ones (failed fetches, 4xx / 5xx)
+// with every page:line they appear on. It reports whether everything was fine.
+func check_links(ctx context.Context, pages []string, out *resultWriter) bool {
+	start := time.Now()
+
+	// 1) the pages themselves; results[i] belongs to pages[i], so the workers never share a slot
+	bodies := make([]cappedBuffer, len(pages))
+	results := make([]fetchResult, len(pages))
+	ch := make(chan fetchResult)
+	go runPool(ctx, *workers, *perHost, listJobs(pages, false), ch, &poolStats{},
+		func(ctx context.Context, j job, ch chan<- fetchResult) {
+			bodies[j.idx].limit = maxPageSize
+			ch <- fetchURLTo(ctx, j.idx, request.get(), j.url, &bodies[j.idx], nil)
+		})
+	for r := range ch {
+		results[r.Index] = r
+	}
+
+	// 2) their links, each target checked once however often it appears
+	uses := make(map[string][]linkUse)
+	var targets []string
+	broken := 0
+	for i, page := range results {
+		if page.Kind != kindOK || page.Status >= 400 {
+			// a page we can't read is as broken as a link pointing at it
+			out.writeBroken(linkUse{Page: page.URL}, page)
+			broken++
+			continue
+		}
+		if !isHTML(page.ContentType) || page.finalURL == nil {
+			continue
+		}
+		for _, l := range extractLinks(bodies[i].Bytes()) {
+			target, ok := resolveLink(page.finalURL, l.Value)
+			if !ok {
+				continue
+			}
+			if uses[target] == nil {
+				targets = append(targets, target)
+			}
+			uses[target] = append(uses[target], linkUse{Page: page.URL, link: l})
+		}
+	}
+
+	checked := make(map[string]fetchResult)
+	ch = make(chan fetchResult)
+	go runPool(ctx, *workers, *perHost, listJobs(targets, false), ch, &poolStats{}, checkLink)
+	for r := range ch {
+		checked[targets[r.Index]] = r
+	}
+
+	// 3) report in the order the links appear: page by page, line by line
+	var all []linkUse
+	for _, target := range targets {
+		for _, use := range uses[target] {
+			use.Value = target
+			all = append(all, use)
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Page != all[j].Page {
+			return pageOrder(results, all[i].Page) < pageOrder(results, all[j].Page)
+		}
+		return all[i].Line < all[j].Line
+	})
+	for _, use := range all {
+		r := checked[use.Value]
+		if (r.Kind == kindOK && r.Status < 400) || r.Kind == kindSkipped {
+			continue
+		}
+		out.writeBroken(use, r)
+		broken++
+	}
+
+	out.flush()
+	fmt.Fprintf(out.log, "checked %d link(s) on %d page(s): %d broken, in %.2fs\n", len(targets), len(pages), broken, time.Since(start).Seconds())
+	return broken == 0
+}
+
+// pageOrder is the position of a page (by its normalized url) on the command line
+func pageOrder(results []fetchResult, page string) int {
+	for i, r := range results {
+		if r.URL == page {
+			return i
+		}
+	}
+	return len(results)
+}
+
+// checkLink asks for the headers of a link only (HEAD); as some servers refuse or mishandle HEAD,
+// any failure is tried again with a full GET, unless the host doesn't even resolve.
+func checkLink(ctx context.Context, j job, ch chan<- fetchResult) {
+	idx, url := j.idx, j.url
+	r := fetchURLTo(ctx, idx, requestSpec{method: http.MethodHead}, url, ioutil.Discard, nil)
+	var dnsErr *net.DNSError
+	if (r.Kind != kindOK || r.Status >= 400) && r.Kind != kindSkipped && r.Kind != kindRobots && !errors.As(r.Err, &dnsErr) && ctx.Err() == nil {
+		r = fetchURLTo(ctx, idx, requestSpec{method: http.MethodGet}, url, ioutil.Discard, nil)
+	}
+	ch <- r
+}
+
+// writeBroken reports a broken link grep-style ("page:line: ..."), or as JSON / CSV
+func (out *resultWriter) writeBroken(use linkUse, r fetchResult) {
+	problem := r.Kind
+	if r.Kind == kindOK {
+		problem = fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+	}
+	switch out.format {
+	case "json":
+		data, _ := json.Marshal(struct {
+			Page    string `json:"page"`
+			Line    int    `json:"line,omitempty"`
+			Tag     string `json:"tag,omitempty"`
+			Attr    string `json:"attr,omitempty"`
+			Link    string `json:"link"`
+			Problem string `json:"problem"`
+			Status  int    `json:"status"`
+			Error   string `json:"error,omitempty"`
+		}{use.Page, use.Line, use.Tag, use.Attr, r.URL, problem, r.Status, r.errString()})
+		fmt.Fprintf(out.w, "%s\n", data)
+	case "csv":
+		out.csvHeader([]string{"page", "line", "tag", "attr", "link", "problem", "status", "error"})
+		out.csv.Write([]string{use.Page, strconv.Itoa(use.Line), use.Tag, use.Attr, r.URL, problem, strconv.Itoa(r.Status), r.errString()})
+	default:
+		if use.Line == 0 {
+			// the page itself
+			fmt.Fprintf(out.w, "%s: %s", use.Page, problem)
+		} else {
+			fmt.Fprintf(out.w, "%s:%d: <%s %s=%q> %s", use.Page, use.Line, use.Tag, use.Attr, r.URL, problem)
+		}
+		if r.Err != nil {
+			fmt.Fprintf(out.w, ": %v", r.Err)
+		}
+		fmt.Fprintln(out.w)
+	}
+}
+
+// robotsPolicy fetches, parses and applies robots.txt (RFC 9309) for -user-agent, once per site
+type robotsPolicy struct {
+	agent string // the product token we look for in User-agent lines: "fetch" for "fetch/1.0"
+
+	mu    sync.Mutex
+	sites map[string]*robotsSite // by scheme://host
+}
+
+// robotsSite is what robots.txt says about us on one site
+type robotsSite struct {
+	ready chan struct{} // closed once group is loaded
+	group robotsGroup
+}
+
+// robotsGroup is a User-agent group: the rules that apply to a set of crawlers
+type robotsGroup struct {
+	agents     []string // as written, lower-cased
+	rules      []robotsRule
+	crawlDelay time.Duration
+	err        error // robots.txt can't be had: nothing may be fetched, and each url fails with err
+}
+
+// robotsRule is one Allow / Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string // a path prefix, possibly with * wildcards and a final $ anchor
+}
+
+func (r robotsRule) String() string {
+	if r.allow {
+		return "Allow: " + r.pattern
+	}
+	return "Disallow: " + r.pattern
+}
+
+func newRobotsPolicy(userAgent string) *robotsPolicy {
+	agent := strings.ToLower(userAgent)
+	if i := strings.IndexAny(agent, "/ "); i >= 0 {
+		agent = agent[:i]
+	}
+	return &robotsPolicy{agent: agent, sites: make(map[string]*robotsSite)}
+}
+
+// allowed reports whether u may be fetched; if not, reason names the rule that blocks it,
+// or err tells why robots.txt can't be had (which blocks the whole site).
+// robots.txt is fetched the first time a site is seen; concurrent callers wait for that one fetch,
+// or until their ctx is done: then the url is let through, to fail with ctx's error.
+func (p *robotsPolicy) allowed(ctx context.Context, rawurl string) (ok bool, reason string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return true, "", nil
+	}
+	if u.Path == "/robots.txt" {
+		return true, "", nil
+	}
+	root := u.Scheme + "://" + u.Host
+	p.mu.Lock()
+	site, seen := p.sites[root]
+	if !seen {
+		site = &robotsSite{ready: make(chan struct{})}
+		p.sites[root] = site
+		go func() {
+			site.group = p.load(root)
+			if site.group.crawlDelay > 0 && polite != nil {
+				polite.slowDown(u.Host, site.group.crawlDelay)
+			}
+			close(site.ready)
+		}()
+	}
+	p.mu.Unlock()
+	select {
+	case <-site.ready:
+	case <-ctx.Done():
+		return true, "", nil
+	}
+	if site.group.err != nil {
+		return false, "", site.group.err
+	}
+
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	rule, matched := site.group.match(path)
+	if !matched || rule.allow {
+		return true, "", nil
+	}
+	return false, fmt.Sprintf("robots.txt: %q for user-agent %q", rule.String(), strings.Join(site.group.agents, ", ")), nil
+}
+
+// robotsTimeout bounds the fetch of a robots.txt, on top of -timeout
+const robotsTimeout = 30 * time.Second
+
+// load fetches root/robots.txt and picks our group out of it.
+//	2xx			the rules as written
+//	4xx			no rules at all
+//	5xx / unreachable	everything disallowed, as RFC 9309 asks (2.3.1.4), with the reason in err
+// The answer is kept for the whole run, so the fetch has a context of its own: it must not depend on
+// the url that happened to ask first being canceled or running out of time.
+func (p *robotsPolicy) load(root string) robotsGroup {
+	ctx, cancelLoad := context.WithTimeout(context.Background(), robotsTimeout)
+	defer cancelLoad()
+	var phases phaseTimings
+	resp, cancel, _, err := send(ctx, http.MethodGet, root+"/robots.txt", nil, nil, &phases)
+	if err != nil {
+		return robotsGroup{err: fmt.Errorf("robots.txt unreachable: %v", err)}
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return robotsGroup{err: fmt.Errorf("robots.txt %s", resp.Status)}
+	case resp.StatusCode >= 400:
+		return robotsGroup{}
+	}
+	// RFC 9309 lets crawlers stop reading after 500 KiB
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500<<10))
+	return parseRobots(string(data), p.agent)
+}
+
+// parseRobots returns the rules of robots.txt that apply to agent:
+// those of every group naming agent, or failing that, of the "*" groups
+func parseRobots(text, agent string) robotsGroup {
+	var groups []*robotsGroup
+	var current *robotsGroup
+	inAgents := false // the previous line was a User-agent line, so the next one joins the same group
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			inAgents = true
+			continue
+		case "allow", "disallow":
+			// an empty Disallow allows everything, i.e. it's no rule at all
+			if current != nil && value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			if secs, err := strconv.ParseFloat(value, 64); current != nil && err == nil && secs > 0 {
+				current.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		}
+		inAgents = false
+	}
+
+	var mine, star robotsGroup
+	for _, g := range groups {
+		for _, a := range g.agents {
+			target := &mine
+			if a == "*" {
+				target = &star
+			} else if a != agent {
+				continue
+			}
+			target.agents = append(target.agents, a)
+			target.rules = append(target.rules, g.rules...)
+			if g.crawlDelay > target.crawlDelay {
+				target.crawlDelay = g.crawlDelay
+			}
+			break
+		}
+	}
+	if len(mine.agents) > 0 {
+		return mine
+	}
+	return star
+}
+
+// match finds the rule for path: the longest matching pattern wins, Allow wins a tie
+func (g robotsGroup) match(path string) (best robotsRule, matched bool) {
+	for _, r := range g.rules {
+		if !robotsMatch(r.pattern, path) {
+			continue
+		}
+		if !matched || len(r.pattern) > len(best.pattern) || (len(r.pattern) == len(best.pattern) && r.allow) {
+			best, matched = r, true
+		}
+	}
+	return best, matched
+}
+
+// robotsMatch matches a path against a robots.txt pattern:
+// a prefix match, where * stands for any run of characters and a final $ anchors the end
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			// the last part must sit at the very end
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
+
+// politeness spaces out requests to each host with a token bucket:
+// -rate requests per second on average, with bursts of up to -burst
+type politeness struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // by host
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second; a request takes one
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newPoliteness(rate float64, burst int) *politeness {
+	if burst < 1 {
+		burst = 1
+	}
+	return &politeness{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+func (p *politeness) bucket(host string) *tokenBucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.buckets[host]
+	if !ok {
+		b = &tokenBucket{rate: p.rate, burst: p.burst, tokens: p.burst, last: time.Now()}
+		p.buckets[host] = b
+	}
+	return b
+}
+
+// slowDown lowers the rate of host to one request per delay, if that's slower than -rate
+func (p *politeness) slowDown(host string, delay time.Duration) {
+	b := p.bucket(host)
+	b.mu.Lock()
+	if rate := 1 / delay.Seconds(); b.rate <= 0 || rate < b.rate {
+		b.rate = rate
+		b.burst = 1
+		if b.tokens > 1 {
+			b.tokens = 1
+		}
+	}
+	b.mu.Unlock()
+}
+
+// wait blocks until host has a token to spare, or ctx is done
+func (p *politeness) wait(ctx context.Context, host string) error {
+	b := p.bucket(host)
+	for {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		need := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		if err := sleep(ctx, need); err != nil {
+			return err
+		}
+	}
+}
+
+// exit codes of a sequential / concurrent run
+const (
+	exitOK      = 0 // every url succeeded (or was skipped by robots.txt)
+	exitUsage   = 2 // bad flags / setup, as the flag package itself does
+	exitPartial = 3 // some urls failed, or were not run (Ctrl-C / -deadline)
+	exitFailed  = 4 // no url succeeded
+)
+
+// isFailure reports whether r counts against the run: no answer at all, or a 4xx / 5xx one
+func (r fetchResult) isFailure() bool {
+	return r.Kind != kindSkipped && (r.Kind != kindOK || r.Status >= 400)
+}
+
+// modeTally collects the results of one mode (sequential or concurrent) for the final summary
+type modeTally struct {
+	mode     string
+	ok       int
+	skipped  int
+	notRun   int // read from the list, but never started because of Ctrl-C or the -deadline
+	failures []fetchResult
+}
+
+func newModeTally(mode string) *modeTally {
+	return &modeTally{mode: mode}
+}
+
+func (t *modeTally) add(r fetchResult) {
+	switch {
+	case r.Kind == kindSkipped:
+		t.skipped++
+	case r.isFailure():
+		t.failures = append(t.failures, r)
+	default:
+		t.ok++
+	}
+}
+
+func (t *modeTally) total() int {
+	return t.ok + t.skipped + t.notRun + len(t.failures)
+}
+
+// printSummary prints one row per mode, then every failure, and returns the exit code
+func printSummary(w io.Writer, tallies []*modeTally) int {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "mode\turls\tok\tfailed\tskipped\tnot run")
+	ok, failed := 0, 0
+	for _, t := range tallies {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", t.mode, t.total(), t.ok, len(t.failures), t.skipped, t.notRun)
+		ok += t.ok
+		// a url never started didn't succeed either
+		failed += len(t.failures) + t.notRun
+	}
+	tw.Flush()
+
+	for _, t := range tallies {
+		// in index order, whatever order the workers finished in
+		sort.Slice(t.failures, func(i, j int) bool { return t.failures[i].Index < t.failures[j].Index })
+		for _, r := range t.failures {
+			if r.Kind == kindOK {
+				fmt.Fprintf(w, "  %s【%s】%d %s (%s)\n", t.mode, r.label(), r.Status, http.StatusText(r.Status), r.URL)
+			} else {
+				fmt.Fprintf(w, "  %s【%s】%s (%s): %v\n", t.mode, r.label(), r.Kind, r.URL, r.Err)
+			}
+		}
+	}
+
+	switch {
+	case failed == 0:
+		return exitOK
+	case ok == 0:
+		return exitFailed
+	}
+	return exitPartial
+}
+
+// monitorEvent is one line of the -history file (JSON Lines). Only changes are kept:
+//	start / stop	a monitor run began / ended (URLs: what it watches)
+//	poll		a round of polls is done (so that a run killed without "stop" still has an end)
+//	first		the first answer of a url ever seen: its status and digest
+//	status		the status code changed (Was -> Status)
+//	content		the body changed (its SHA-256)
+//	down / up	a url stopped / started answering with a 2xx / 3xx; "up" carries how long it was down
+type monitorEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	URL     string    `json:"url,omitempty"`
+	URLs    []string  `json:"urls,omitempty"`
+	Status  int       `json:"status,omitempty"`
+	Was     int       `json:"was,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	DownFor float64   `json:"down_for_s,omitempty"`
+}
+
+// urlState is what the monitor knows about a url: the last answer, and since when it is down
+type urlState struct {
+	seen      bool
+	status    int
+	sha256    string
+	down      bool
+	downSince time.Time
+}
+
+// monitor polls urls every -monitor interval until Ctrl-C or the -deadline,
+// printing every change and appending it to the -history file
+func monitor(ctx context.Context, urls []string, out *resultWriter) error {
+	for i, u := range urls {
+		if normalized, err := normalizeURL(u); err == nil {
+			urls[i] = normalized
+		}
+	}
+	// carry on where the last run stopped: a url that was down is still down, the same body is no news
+	events, err := readHistory(*history)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	states := make(map[string]*urlState)
+	for _, u := range urls {
+		states[u] = &urlState{}
+	}
+	for _, e := range events {
+		if s := states[e.URL]; s != nil {
+			s.replay(e)
+		}
+	}
+
+	file, err := os.OpenFile(*history, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	enc := json.NewEncoder(file)
+	record := func(e monitorEvent) {
+		if err := enc.Encode(e); err != nil {
+			fmt.Fprintf(os.Stderr, "Error during writing %s: %v\n", *history, err)
+		}
+		if e.URL != "" {
+			out.writeEvent(e)
+		}
+	}
+
+	record(monitorEvent{Time: time.Now(), Event: "start", URLs: urls})
+	fmt.Fprintf(out.log, "monitoring %d url(s) every %s, history in %s\n", len(urls), *pollEvery, *history)
+	ticker := time.NewTicker(*pollEvery)
+	defer ticker.Stop()
+	for {
+		// the events of a poll are stamped with its start: a url that doesn't answer takes its retries
+		// and -timeout to say so, but it was down already when the poll began
+		started := time.Now()
+		for _, r := range monitorPoll(ctx, urls) {
+			if ctx.Err() != nil {
+				// a poll cut short by Ctrl-C says nothing about the url
+				break
+			}
+			for _, e := range states[r.URL].update(r, started) {
+				record(e)
+			}
+		}
+		if ctx.Err() == nil {
+			record(monitorEvent{Time: time.Now(), Event: "poll"})
+		}
+		out.flush()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			record(monitorEvent{Time: time.Now(), Event: "stop"})
+			return nil
+		}
+	}
+}
+
+// monitorPoll fetches every url once, with the worker pool, and hashes each body
+func monitorPoll(ctx context.Context, urls []string) []fetchResult {
+	results := make([]fetchResult, len(urls))
+	ch := make(chan fetchResult)
+	go runPool(ctx, *workers, *perHost, listJobs(urls, false), ch, &poolStats{},
+		func(ctx context.Context, j job, ch chan<- fetchResult) {
+			var body bytes.Buffer
+			r := fetchURLTo(ctx, j.idx, request.get(), j.url, &body, nil)
+			if !r.isFailure() {
+				// the digest of the whole body, like【sha256.Sum256】in 3_composite_types_arrays.go;
+				// error pages are left out, so that "content" compares good answers only
+				sum := sha256.Sum256(body.Bytes())
+				r.SHA256 = hex.EncodeToString(sum[:])
+			}
+			// keep the url as given: the results are matched against urls
+			r.URL = j.url
+			ch <- r
+		})
+	for r := range ch {
+		results[r.Index] = r
+	}
+	return results
+}
+
+// update compares a poll (started at now) with what came before, and returns the resulting events
+func (s *urlState) update(r fetchResult, now time.Time) []monitorEvent {
+	var events []monitorEvent
+	down := r.isFailure()
+	switch {
+	case !s.seen:
+		events = append(events, monitorEvent{Time: now, Event: "first", URL: r.URL, Status: r.Status, SHA256: r.SHA256})
+	case r.Status != 0 && r.Status != s.status:
+		events = append(events, monitorEvent{Time: now, Event: "status", URL: r.URL, Status: r.Status, Was: s.status})
+	}
+	if s.seen && r.SHA256 != "" && s.sha256 != "" && r.SHA256 != s.sha256 {
+		events = append(events, monitorEvent{Time: now, Event: "content", URL: r.URL, Status: r.Status, SHA256: r.SHA256})
+	}
+	if down && !s.down {
+		events = append(events, monitorEvent{Time: now, Event: "down", URL: r.URL, Status: r.Status, Error: downReason(r)})
+	}
+	if !down && s.down {
+		events = append(events, monitorEvent{Time: now, Event: "up", URL: r.URL, Status: r.Status,
+			DownFor: now.Sub(s.downSince).Seconds()})
+	}
+	for _, e := range events {
+		s.replay(e)
+	}
+	return events
+}
+
+// replay brings s up to date with an event of its url
+func (s *urlState) replay(e monitorEvent) {
+	s.seen = true
+	if e.Status != 0 {
+		s.status = e.Status
+	}
+	if e.SHA256 != "" {
+		s.sha256 = e.SHA256
+	}
+	switch e.Event {
+	case "down":
+		s.down, s.downSince = true, e.Time
+	case "up":
+		s.down = false
+	}
+}
+
+// downReason says why a poll counts as down: the error, or the 4xx / 5xx status
+func downReason(r fetchResult) string {
+	if r.Kind != kindOK {
+		return fmt.Sprintf("%s: %v", r.Kind, r.Err)
+	}
+	return fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+}
+
+// writeEvent prints a monitor event: a line of text, or the event itself as JSON / CSV
+func (out *resultWriter) writeEvent(e monitorEvent) {
+	switch out.format {
+	case "json":
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(out.w, "%s\n", data)
+	case "csv":
+		out.csvHeader([]string{"time", "event", "url", "status", "was", "sha256", "error", "down_for_s"})
+		out.csv.Write([]string{e.Time.Format(time.RFC3339), e.Event, e.URL, strconv.Itoa(e.Status), strconv.Itoa(e.Was),
+			e.SHA256, e.Error, strconv.FormatFloat(e.DownFor, 'f', 3, 64)})
+	default:
+		fmt.Fprintf(out.w, "%s %-7s %s: %s\n", e.Time.Format("2006-01-02 15:04:05"), strings.ToUpper(e.Event), e.URL, e.detail())
+	}
+}
+
+// detail is the text form of what a url event says
+func (e monitorEvent) detail() string {
+	switch e.Event {
+	case "first":
+		if e.SHA256 == "" {
+			// down from the start: the "down" event that follows says why
+			return "no body"
+		}
+		return fmt.Sprintf("%d %s, sha256 %.12s", e.Status, http.StatusText(e.Status), e.SHA256)
+	case "status":
+		return fmt.Sprintf("%d -> %d %s", e.Was, e.Status, http.StatusText(e.Status))
+	case "content":
+		return fmt.Sprintf("sha256 now %.12s", e.SHA256)
+	case "down":
+		return e.Error
+	case "up":
+		return fmt.Sprintf("%d %s, after %s down", e.Status, http.StatusText(e.Status),
+			time.Duration(e.DownFor*float64(time.Second)).Round(time.Second))
+	}
+	return ""
+}
+
+// readHistory loads a -history file
+func readHistory(name string) ([]monitorEvent, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var events []monitorEvent
+	input := bufio.NewScanner(file)
+	input.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; input.Scan(); line++ {
+		var e monitorEvent
+		if err := json.Unmarshal(input.Bytes(), &e); err != nil {
+			// a run killed halfway through a line: skip it, keep the rest
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", name, line, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, input.Err()
+}
+
+// span is a time interval [from, to)
+type span struct {
+	from, to time.Time
+}
+
+// overlap is how much of s lies within t
+func (s span) overlap(t span) time.Duration {
+	from, to := s.from, s.to
+	if t.from.After(from) {
+		from = t.from
+	}
+	if t.to.Before(to) {
+		to = t.to
+	}
+	if to.Before(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// urlReport is the report subcommand's view of one url
+type urlReport struct {
+	url    string
+	runs   []span // the monitor runs that watched it, each from its first observation of the url
+	down   []span
+	events []monitorEvent
+}
+
+// report is the "report" subcommand: uptime and timeline of every url in the -history file
+//	go run 1_fetching-url.go report [-history file] [url ...]
+// Urls given on the command line narrow the report down to them.
+func report(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	historyFile := flags.String("history", *history, "the history file written by -monitor")
+	flags.Parse(args)
+
+	events, err := readHistory(*historyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	wanted := make(map[string]bool)
+	for _, u := range flags.Args() {
+		if normalized, err := normalizeURL(u); err == nil {
+			u = normalized
+		}
+		wanted[u] = true
+	}
+
+	// 1) the monitor runs, each from its "start" to its "stop", or to its last event if it was killed.
+	// For a url, a run only counts from its first observation on: its first event in the run,
+	// or else the end of the first poll, when every url had been looked at; before that, its state is unknown.
+	var (
+		reports  = make(map[string]*urlReport)
+		order    []string
+		watching []string
+		observed map[string]time.Time // url -> its first observation in the run
+		open     bool
+		last     time.Time
+	)
+	get := func(u string) *urlReport {
+		if reports[u] == nil {
+			reports[u] = &urlReport{url: u}
+			order = append(order, u)
+		}
+		return reports[u]
+	}
+	closeRun := func(end time.Time) {
+		if !open {
+			return
+		}
+		for _, u := range watching {
+			r := get(u)
+			if from, ok := observed[u]; ok && from.Before(end) {
+				r.runs = append(r.runs, span{from, end})
+			}
+		}
+		open = false
+	}
+	for _, e := range events {
+		switch e.Event {
+		case "start":
+			closeRun(last)
+			watching, observed, open = e.URLs, make(map[string]time.Time), true
+		case "stop":
+			closeRun(e.Time)
+		case "poll":
+			for _, u := range watching {
+				if _, ok := observed[u]; !ok && open {
+					observed[u] = e.Time
+				}
+			}
+		default:
+			r := get(e.URL)
+			r.events = append(r.events, e)
+			if _, ok := observed[e.URL]; !ok && open {
+				observed[e.URL] = e.Time
+			}
+		}
+		last = e.Time
+	}
+	closeRun(last)
+
+	// 2) the downtime windows, counted inside the runs that watched the url only: nobody looked in between
+	for _, r := range reports {
+		var downSince *time.Time
+		for _, e := range r.events {
+			switch e.Event {
+			case "down":
+				t := e.Time
+				downSince = &t
+			case "up":
+				if downSince != nil {
+					r.down = append(r.down, span{*downSince, e.Time})
+					downSince = nil
+				}
+			}
+		}
+		if downSince != nil {
+			r.down = append(r.down, span{*downSince, last})
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "url\tmonitored\tdown\tuptime\toutages\tstatus changes\tcontent changes")
+	for _, u := range order {
+		if len(wanted) > 0 && !wanted[u] {
+			continue
+		}
+		r := reports[u]
+		var monitored, down time.Duration
+		for _, run := range r.runs {
+			monitored += run.to.Sub(run.from)
+			for _, d := range r.down {
+				down += d.overlap(run)
+			}
+		}
+		uptime := "-"
+		if monitored > 0 {
+			uptime = fmt.Sprintf("%.2f%%", 100*(1-down.Seconds()/monitored.Seconds()))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", u, monitored.Round(time.Second), down.Round(time.Second), uptime,
+			len(r.down), r.count("status"), r.count("content"))
+	}
+	tw.Flush()
+
+	for _, u := range order {
+		if len(wanted) > 0 && !wanted[u] {
+			continue
+		}
+		fmt.Printf("\n%s\n", u)
+		for _, e := range reports[u].events {
+			fmt.Printf("  %s %-7s %s\n", e.Time.Format("2006-01-02 15:04:05"), strings.ToUpper(e.Event), e.detail())
+		}
+	}
+	return exitOK
+}
+
+func (r *urlReport) count(event string) int {
+	n := 0
+	for _, e := range r.events {
+		if e.Event == event {
+			n++
+		}
+	}
+	return n
+}
+
+// har is set when -har is given: every fetch is recorded, and written out as a HAR 1.2 file at the end
+var har *harRecorder
+
+// harRecorder collects one HAR entry per fetch (of its last attempt, after redirects)
+type harRecorder struct {
+	bodies bool // -har-bodies
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// harExchange is what fetchURLTo knows about a request by the time it returns
+type harExchange struct {
+	method    string
+	url       string
+	body      []byte // the request body
+	resp      *http.Response
+	headersAt time.Time // when the response headers arrived
+	content   *cappedBuffer
+}
+
+// the HAR 1.2 format, as far as fetch fills it in (http://www.softwareishard.com/blog/har-12-spec/);
+// fields starting with "_" are custom ones, which the format allows
+type harDocument struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"` // ms, the sum of the timings
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Attempts        int         `json:"_attempts"`
+	Kind            string      `json:"_kind"`
+	Error           string      `json:"_error,omitempty"`
+
+	started time.Time
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harNV      `json:"cookies"`
+	Headers     []harNV      `json:"headers"`
+	QueryString []harNV      `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNV    `json:"cookies"`
+	Headers     []harNV    `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"` // bytes saved by the Content-Encoding
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // "base64" for a body that isn't UTF-8 text
+	Truncated   bool   `json:"_truncated,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 when a phase didn't happen (a reused connection has no dns / connect)
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"` // TLS included, as the format wants
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harNV is a name / value pair: a header, a cookie or a query parameter
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func newHARRecorder(bodies bool) *harRecorder {
+	return &harRecorder{bodies: bodies}
+}
+
+// a -har-bodies body is cut off after this many bytes
+const maxHARBody = 1 << 20
+
+// capture tees a response body into the exchange (up to maxHARBody), with -har-bodies
+func (ex *harExchange) capture(body io.ReadCloser) io.ReadCloser {
+	ex.content = &cappedBuffer{limit: maxHARBody}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, ex.content), body}
+}
+
+// add turns an exchange and its result into an entry
+func (h *harRecorder) add(ex *harExchange, r fetchResult) {
+	now := time.Now()
+	e := harEntry{Attempts: r.Attempts, Kind: r.Kind, Error: r.errString(), started: now.Add(-r.Elapsed)}
+	e.Request = harRequest{Method: ex.method, URL: ex.url, HTTPVersion: "HTTP/1.1", HeadersSize: -1, BodySize: len(ex.body)}
+	e.Response = harResponse{HeadersSize: -1, Cookies: []harNV{}, Headers: []harNV{}}
+
+	// the request as it went out: the last one of the redirect chain, or a rebuilt one if none did
+	req := (*http.Request)(nil)
+	if ex.resp != nil {
+		req = ex.resp.Request
+	} else if rebuilt, err := http.NewRequest(ex.method, ex.url, nil); err == nil {
+		setHeaders(rebuilt, ex.body, nil)
+		req = rebuilt
+	}
+	if req != nil {
+		e.Request.URL = req.URL.String()
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		// net/http sends Host out of req.Host, not the header map
+		e.Request.Headers = append([]harNV{{"Host", host}}, harHeaders(req.Header)...)
+		e.Request.Cookies = []harNV{}
+		for _, c := range req.Cookies() {
+			e.Request.Cookies = append(e.Request.Cookies, harNV{c.Name, c.Value})
+		}
+		e.Request.QueryString = []harNV{}
+		for name, values := range req.URL.Query() {
+			for _, value := range values {
+				e.Request.QueryString = append(e.Request.QueryString, harNV{name, value})
+			}
+		}
+		if ex.body != nil {
+			e.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: string(ex.body)}
+		}
+	}
+
+	e.Timings = harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 0, Wait: 0, Receive: 0}
+	if resp := ex.resp; resp != nil {
+		p := r.Phases
+		if !p.Reused {
+			if p.DNS > 0 {
+				// an IP literal has no lookup
+				e.Timings.DNS = msFloat(p.DNS)
+			}
+			e.Timings.Connect = msFloat(p.Connect + p.TLS)
+			if p.TLS > 0 {
+				e.Timings.SSL = msFloat(p.TLS)
+			}
+		}
+		e.Timings.Send = msFloat(max(p.Sent-p.DNS-p.Connect-p.TLS, 0))
+		e.Timings.Wait = msFloat(max(p.TTFB-p.Sent, 0))
+		e.Timings.Receive = msFloat(now.Sub(ex.headersAt))
+		e.started = ex.headersAt.Add(-p.TTFB)
+
+		e.Request.HTTPVersion = resp.Proto
+		e.Response.Status = resp.StatusCode
+		e.Response.StatusText = http.StatusText(resp.StatusCode)
+		e.Response.HTTPVersion = resp.Proto
+		e.Response.Headers = harHeaders(resp.Header)
+		for _, c := range resp.Cookies() {
+			e.Response.Cookies = append(e.Response.Cookies, harNV{c.Name, c.Value})
+		}
+		e.Response.RedirectURL = resp.Header.Get("Location")
+		e.Response.BodySize = r.Bytes
+		e.Response.Content = harContent{Size: r.Bytes, MimeType: resp.Header.Get("Content-Type")}
+		if r.Encoding != "" && r.EncodingSupported {
+			// bodySize is what came over the wire, content.size what it decoded to
+			e.Response.BodySize = r.WireBytes
+			e.Response.Content.Compression = r.Bytes - r.WireBytes
+		}
+		if c := ex.content; c != nil {
+			if utf8.Valid(c.Bytes()) {
+				e.Response.Content.Text = c.String()
+			} else {
+				e.Response.Content.Text = base64.StdEncoding.EncodeToString(c.Bytes())
+				e.Response.Content.Encoding = "base64"
+			}
+			e.Response.Content.Truncated = int64(c.Len()) < r.Bytes
+		}
+	} else {
+		// no answer: the whole time went into waiting for one
+		e.Timings.Wait = msFloat(r.Elapsed)
+	}
+	e.StartedDateTime = e.started.Format(time.RFC3339Nano)
+	for _, t := range []float64{e.Timings.Blocked, e.Timings.DNS, e.Timings.Connect, e.Timings.Send, e.Timings.Wait, e.Timings.Receive} {
+		if t > 0 {
+			e.Time += t
+		}
+	}
+
+	h.mu.Lock()
+	h.entries = append(h.entries, e)
+	h.mu.Unlock()
+}
+
+// write saves the entries, in the order the requests started
+func (h *harRecorder) write(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sort.SliceStable(h.entries, func(i, j int) bool { return h.entries[i].started.Before(h.entries[j].started) })
+	var file harDocument
+	file.Log.Version = "1.2"
+	file.Log.Creator = harCreator{Name: "fetch", Version: "1.0"}
+	file.Log.Entries = h.entries
+	if file.Log.Entries == nil {
+		file.Log.Entries = []harEntry{}
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// harHeaders lists header fields in name order
+func harHeaders(header http.Header) []harNV {
+	list := []harNV{}
+	for name, values := range header {
+		for _, value := range values {
+			list = append(list, harNV{name, value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// msFloat is a duration in (fractional) milliseconds
+func msFloat(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+// jobSource opens the url list once per mode:
+//	-i file		the file, read again for every mode
+//	-i -		stdin; with -mode both it is spooled to a temporary file first, as it can only be read once
+//	otherwise	the command-line arguments
+// cleanup removes the spool file, if any.
+func jobSource(args []string, input string, modes int) (open func(ctx context.Context) <-chan job, cleanup func(), err error) {
+	cleanup = func() {}
+	switch {
+	case input == "":
+		return func(ctx context.Context) <-chan job { return listJobs(args, true) }, cleanup, nil
+	case input == "-" && modes == 1:
+		return func(ctx context.Context) <-chan job { return readJobs(ctx, os.Stdin, nil) }, cleanup, nil
+	case input == "-":
+		spool, err := os.CreateTemp("", "fetch-urls-*.txt")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.Remove(spool.Name()) }
+		_, err = io.Copy(spool, os.Stdin)
+		if closeErr := spool.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		input = spool.Name()
+	}
+	if _, err := os.Stat(input); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return func(ctx context.Context) <-chan job {
+		file, err := os.Open(input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			jobs := make(chan job)
+			close(jobs)
+			return jobs
+		}
+		return readJobs(ctx, file, file)
+	}, cleanup, nil
+}
+
+// listJobs hands out urls in order, optionally dropping duplicates. It doesn't stop at Ctrl-C / the -deadline:
+// the consumer reads the rest to count it as not run.
+func listJobs(urls []string, dedupe bool) <-chan job {
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		seen := make(map[[16]byte]bool)
+		idx := 0
+		for _, url := range urls {
+			if dedupe && !firstSighting(seen, url) {
+				continue
+			}
+			jobs <- job{idx: idx, url: url}
+			idx++
+		}
+	}()
+	return jobs
+}
+
+// readJobs streams the urls of r, one per line, skipping blank lines, # comments and duplicates;
+// each job remembers its line. Only the set of urls seen so far is kept, not the list.
+// As listJobs, it goes on after Ctrl-C / the -deadline, so that the rest is counted as not run;
+// but not on a terminal, where the rest is what hasn't been typed yet.
+func readJobs(ctx context.Context, r io.Reader, closer io.Closer) <-chan job {
+	var stop <-chan struct{}
+	if f, ok := r.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			stop = ctx.Done()
+		}
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		if closer != nil {
+			defer closer.Close()
+		}
+		seen := make(map[[16]byte]bool)
+		input := bufio.NewScanner(r)
+		// allow long urls (up to 1 MiB) instead of the default 64 KiB lines
+		input.Buffer(make([]byte, 64<<10), 1<<20)
+		idx, line := 0, 0
+		for input.Scan() {
+			line++
+			url := strings.TrimSpace(input.Text())
+			if url == "" || strings.HasPrefix(url, "#") || !firstSighting(seen, url) {
+				continue
+			}
+			select {
+			case jobs <- job{idx: idx, line: line, url: url}:
+				idx++
+			case <-stop:
+				return
+			}
+		}
+		if err := input.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error during reading urls (line %d): %v\n", line+1, err)
+		}
+	}()
+	return jobs
+}
+
+// firstSighting reports whether url (once normalized) is new to seen, and records it.
+// seen keeps a 16-byte digest per url instead of the url itself, to stay small on huge lists.
+func firstSighting(seen map[[16]byte]bool, url string) bool {
+	if normalized, err := normalizeURL(url); err == nil {
+		url = normalized
+	}
+	sum := sha256.Sum256([]byte(url))
+	var key [16]byte
+	copy(key[:], sum[:16])
+	if seen[key] {
+		return false
+	}
+	seen[key] = true
+	return true
+}
+
+// collect drains jobs into a plain list, for the modes that need all urls up front
+func collect(jobs <-chan job) []string {
+	var urls []string
+	for j := range jobs {
+		urls = append(urls, j.url)
+	}
+	return urls
 }
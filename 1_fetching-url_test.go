@@ -0,0 +1,276 @@
+/*
+	Tests of 1_fetching-url.go, against local【httptest】servers: no network needed.
+
+	go test 1_fetching-url.go 1_fetching-url_test.go
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPhasesPlainHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+
+	var phases phaseTimings
+	resp, cancel, tries, err := send(context.Background(), http.MethodGet, srv.URL, nil, nil, &phases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	cancel()
+	if tries != 1 {
+		t.Errorf("tries = %d, want 1", tries)
+	}
+	// an IP literal: no DNS; http: no TLS
+	if phases.DNS != 0 || phases.TLS != 0 {
+		t.Errorf("dns %v, tls %v: want neither", phases.DNS, phases.TLS)
+	}
+	if phases.Connect <= 0 || phases.Reused {
+		t.Errorf("connect %v, reused %v: want a new connection", phases.Connect, phases.Reused)
+	}
+	if phases.TTFB < 20*time.Millisecond || phases.Sent > phases.TTFB {
+		t.Errorf("sent %v, ttfb %v: want sent <= ttfb, and ttfb >= the 20ms the handler sleeps", phases.Sent, phases.TTFB)
+	}
+
+	// the 2nd request takes the keep-alive connection of the 1st one: nothing to connect
+	resp, cancel, _, err = send(context.Background(), http.MethodGet, srv.URL, nil, nil, &phases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cancel()
+	if !phases.Reused || phases.Connect != 0 {
+		t.Errorf("reused %v, connect %v: want a reused connection", phases.Reused, phases.Connect)
+	}
+}
+
+func TestPhasesTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+	// send uses http.DefaultClient: make it trust the test certificate
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	http.DefaultClient = srv.Client()
+
+	var phases phaseTimings
+	resp, cancel, _, err := send(context.Background(), http.MethodGet, srv.URL, nil, nil, &phases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cancel()
+	if phases.TLS <= 0 || phases.Connect <= 0 || phases.TTFB <= 0 {
+		t.Errorf("connect %v, tls %v, ttfb %v: want all of them", phases.Connect, phases.TLS, phases.TTFB)
+	}
+}
+
+// a 2nd run takes the body from -cache on a 304: -o must still save all of it, not the 304's empty body
+func TestCacheHitSaved(t *testing.T) {
+	const body = "hello, cache"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+	defer func() { cache, saver = nil, nil }()
+	// fetchURL sends the request main builds from -X / -d / -H
+	defer func(spec requestSpec) { request = spec }(request)
+	request = requestSpec{method: http.MethodGet}
+
+	cacheDir, outDir := t.TempDir(), t.TempDir()
+	sum := sha256.Sum256([]byte(body))
+	for run := 1; run <= 2; run++ {
+		var err error
+		if cache, err = newHTTPCache(cacheDir); err != nil {
+			t.Fatal(err)
+		}
+		if saver, err = newBodySaver(outDir); err != nil {
+			t.Fatal(err)
+		}
+		result := fetchURL(context.Background(), 0, srv.URL+"/a.txt", io.Discard)
+		if result.Kind != kindOK || result.Cached != (run == 2) {
+			t.Fatalf("run %d: %s, cached %v, err %v", run, result.Kind, result.Cached, result.Err)
+		}
+		if err := saver.writeManifest(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(result.SavedPath)
+		if err != nil || string(data) != body {
+			t.Errorf("run %d: %s holds %q, %v; want %q", run, result.SavedPath, data, err, body)
+		}
+		if result.Bytes != int64(len(body)) || result.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("run %d: %d bytes, sha256 %s; want those of %q", run, result.Bytes, result.SHA256, body)
+		}
+	}
+}
+
+func TestRetryableErr(t *testing.T) {
+	var policy retryPolicy
+
+	// a certificate nobody vouches for fails the same way every time
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// the server side of the refused handshake would be logged
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	_, err := http.Get(srv.URL)
+	srv.Close()
+	if err == nil || policy.retryableErr(err) {
+		t.Errorf("unknown authority: err %v, want an error not to retry", err)
+	}
+
+	// nobody listens on a closed server's port
+	_, err = http.Get(srv.URL)
+	if err == nil || !policy.retryableErr(err) {
+		t.Errorf("connection refused: err %v, want an error to retry", err)
+	}
+
+	wrap := func(err error) error { return &url.Error{Op: "Get", URL: "http://example.com/", Err: err} }
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{wrap(&net.DNSError{Err: "no such host", Name: "nosuch.invalid", IsNotFound: true}), false},
+		{wrap(&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}), true},
+		{wrap(&tls.CertificateVerificationError{Err: errors.New("x509: certificate has expired")}), false},
+		{wrap(errors.New("stopped after 10 redirects")), false},
+		{wrap(errors.New(`unsupported protocol scheme "ftp"`)), false},
+		{wrap(context.DeadlineExceeded), true},
+		{wrap(context.Canceled), false},
+	} {
+		if got := policy.retryableErr(test.err); got != test.want {
+			t.Errorf("retryableErr(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for _, test := range []struct {
+		raw, want string
+	}{
+		{"example.com", "http://example.com/"},
+		{"example.com:8080/a", "http://example.com:8080/a"},
+		{"HTTPS://Example.COM:443", "https://example.com/"},
+		{"http://example.com:80/a?b", "http://example.com/a?b"},
+		{"::1", "http://[::1]/"},
+		{"[::1]:8080", "http://[::1]:8080/"},
+		{"fe80::1%eth0", "http://[fe80::1%25eth0]/"},
+		{"http://[FE80::1%25Eth0]:8080/", "http://[fe80::1%25Eth0]:8080/"},
+		{"data:,Hello", "data:,Hello"},
+	} {
+		got, err := normalizeURL(test.raw)
+		if err != nil || got != test.want {
+			t.Errorf("normalizeURL(%q) = %q, %v; want %q", test.raw, got, err, test.want)
+		}
+	}
+	for _, raw := range []string{"", "ftp://example.com/", "mailto:a@b", "javascript:void(0)", "http:///a"} {
+		if got, err := normalizeURL(raw); err == nil {
+			t.Errorf("normalizeURL(%q) = %q, want an error", raw, got)
+		}
+	}
+}
+
+func TestParseDataURL(t *testing.T) {
+	for _, test := range []struct {
+		raw, mediaType, data string
+	}{
+		{"data:,Hello%2C%20World", "text/plain;charset=US-ASCII", "Hello, World"},
+		{"data:text/plain;base64,SGk=", "text/plain", "Hi"},
+		{"data:text/html,<p>a</p>", "text/html", "<p>a</p>"},
+	} {
+		mediaType, data, err := parseDataURL(test.raw)
+		if err != nil || mediaType != test.mediaType || string(data) != test.data {
+			t.Errorf("parseDataURL(%q) = %q, %q, %v; want %q, %q", test.raw, mediaType, data, err, test.mediaType, test.data)
+		}
+	}
+	for _, raw := range []string{"data:text/plain", "data:;base64,!!!", "http://example.com/"} {
+		if _, _, err := parseDataURL(raw); err == nil {
+			t.Errorf("parseDataURL(%q): want an error", raw)
+		}
+	}
+}
+
+func TestRobotsMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/anything", true},
+		{"/private", "/private/a", true},
+		{"/private", "/public", false},
+		{"/*.gif$", "/a/b.gif", true},
+		{"/*.gif$", "/a/b.gif?x", false},
+		{"/a*c", "/abbbc/d", true},
+		{"/a*c", "/ab", false},
+		{"/exact$", "/exact", true},
+		{"/exact$", "/exactly", false},
+	} {
+		if got := robotsMatch(test.pattern, test.path); got != test.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Errorf(`parseRetryAfter("3") = %v, want 3s`, got)
+	}
+	for _, value := range []string{"", "0", "-1", "soon"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", value, got)
+		}
+	}
+	when := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(when); got < 55*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v, want about 1m", when, got)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for _, test := range []struct {
+		p    int
+		want time.Duration
+	}{
+		{0, 1 * time.Millisecond},
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{99, 10 * time.Millisecond},
+		{100, 10 * time.Millisecond},
+	} {
+		if got := percentile(sorted, test.p); got != test.want {
+			t.Errorf("percentile(1..10ms, %d) = %v, want %v", test.p, got, test.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile(nil, 50) = %v, want 0", got)
+	}
+}
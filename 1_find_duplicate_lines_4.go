@@ -0,0 +1,835 @@
+/*
+	Find duplicate lines - version 4 - unified: standard input / a list of file names
+		-mode stream	version 2: input is read & broken into lines as needed (the default)
+		-mode gulp	version 3: read each entire file into memory & split it into lines all at once
+		-mode external	for inputs larger than memory: lines are spilled into partition files on disk, counted one by one
+
+	go run 1_find_duplicate_lines_4.go [-mode stream|gulp|external] [-mem MiB] [-partitions P] [-tmpdir dir] [-n] [-max-locations N]
+		[-sort count|text|first|file] [-top N] [-min-count K]
+		[-i] [-space trim|collapse] [-strip regexp ...] [-unicode compose|width] [-spellings N] [file ...]
+
+	For every duplicated line it reports the total count, and which files it appears in, how often in each:
+		Found duplicates:【line】appears【5】times, in 2 file(s): a.conf (3), b.conf (2);
+	Without file names (or with "-") it reads standard input, which stops at a line "end" as in version 1.
+	Both modes see the same lines: the newline (and a "\r" before it) is not part of a line,
+	and a file ending with a newline has no empty last line.
+
+	With -n it lists every occurrence instead, grep-style, so that an editor can jump to each of them:
+		a.conf:12: line
+		a.conf:40: line
+		b.conf:3: line
+	-max-locations keeps at most N locations per line (0 = all of them), to bound the memory they take;
+	how many were left out is reported on standard error.
+
+	The output order is fixed, so that two runs over the same input can be diffed:
+		-sort count	most frequent first; equal counts in lexicographic order (the default)
+		-sort text	lexicographic order of the lines
+		-sort first	in the order the lines first appear (the files in the order given)
+		-sort file	by the name of the first file a line appears in, then by its line number there
+	-min-count K reports the lines appearing at least K times (2: the duplicates),
+	-top N only the first N of them, in the -sort order (0 = all).
+
+	Lines can be normalized before they are counted, so that lines which differ only a little count as the same,
+	in this order:
+		-unicode compose	compose accented letters, kana with voicing marks and Hangul jamo into one character:
+				"e" + U+0301 is "é", "か" + U+3099 is "が", "ᄒ" + "ᅡ" + "ᆫ" (U+1112 U+1161 U+11AB) is "한"
+		-unicode width	compose, and full-width ASCII ("ＡＢＣ１２３") and half-width katakana ("ｶﾞ") become ordinary ("ABC123", "ガ")
+		-strip regexp	delete every match of regexp (timestamps, request IDs...); repeatable, applied in the order given
+		-i		ignore case
+		-space trim	drop leading and trailing whitespace
+		-space collapse	trim, and turn every run of whitespace inside into ONE space
+	The normalized line is then reported, followed by how it was spelled in the input (at most -spellings of them):
+		Found duplicates:【get /index.html】appears【3】times, in 1 file(s): access.log (3); spelled:【GET /index.html】【get /index.html】;
+	With -n each location shows the line as spelled there.
+	The -unicode forms are NOT Unicode's NFC / NFKC, which need the Unicode character database (golang.org/x/text), but what of them
+	matters most for CJK and European text, built into the program:
+		compose	the pairs in the compositions table below, and EVERY Hangul syllable (computed, as Unicode does)
+		width	U+FF01..U+FF5E -> ASCII, the ideographic space U+3000 -> " ", half-width katakana U+FF61..U+FF9F
+	Not covered: other accented letters, several marks on one letter (only the first one composes), text that is
+	already composed and would need decomposing, half-width Hangul and compatibility jamo (U+3131..), and the other
+	compatibility characters (ligatures, circled digits, CJK compatibility ideographs...): they are left as they are.
+
+	-mode external reads the inputs line by line, as stream does, but keeps no line in memory: each one is written
+	to ONE of P partition files in a temporary directory (under -tmpdir), chosen by the hash of its normalized text,
+	so that all the occurrences of a line are in the same partition. Then the partitions are counted one at a time,
+	and only the lines reported are kept. The output is the same as that of the other modes.
+	-mem is the memory, in MiB, that counting ONE partition may take. While spilling, what the lines of each partition
+	would take counted (some 200 bytes a distinct line besides its text) is added up, and a partition over -mem is
+	split again, by another hash, before it is counted: standard input, which has no size, keeps to -mem as files do.
+	P is derived from -mem and the size of the files (16 for standard input), or given with -partitions;
+	at most 128 partition files are written at once, well below the open files a process may have
+	(ulimit -n: 1024 on Linux, 256 on macOS), so a larger -partitions is 128, and more are made by splitting again.
+	The lines reported, and their locations with -n, are still held in memory until they are printed.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	mode         = flag.String("mode", "stream", "how files are read: stream (line by line), gulp (whole file at once) or external (spilled to disk)")
+	memBudget    = flag.Int("mem", 256, "-mode external: memory in MiB for counting one partition")
+	partitions   = flag.Int("partitions", 0, "-mode external: number of partition files, at most 128 (0 = from -mem and the input size)")
+	tmpDir       = flag.String("tmpdir", "", "-mode external: where the partition files go (default: the system temporary directory)")
+	withLines    = flag.Bool("n", false, "print every occurrence as file:line: text")
+	maxLocations = flag.Int("max-locations", 0, "with -n: keep at most this many locations per line (0 = all)")
+	sortBy       = flag.String("sort", "count", "output order: count, text, first or file")
+	top          = flag.Int("top", 0, "report only the first N lines in the -sort order (0 = all)")
+	minCount     = flag.Int("min-count", 2, "report lines appearing at least this many times")
+	foldCase     = flag.Bool("i", false, "ignore case")
+	space        = flag.String("space", "", "whitespace: trim (leading and trailing) or collapse (trim, and runs inside to one space)")
+	unicodeForm  = flag.String("unicode", "", "compose (accents, kana voicing marks, Hangul jamo) or width (compose, and fold full-width / half-width forms)")
+	spellings    = flag.Int("spellings", 3, "with normalization: show at most this many original spellings of a line")
+	strips       regexpList
+)
+
+func init() {
+	flag.Var(&strips, "strip", "delete every match of this regexp before counting (repeatable)")
+}
+
+// fileCount is how often a line appears in ONE file
+type fileCount struct {
+	name  string
+	count int
+}
+
+// location is where ONE occurrence of a line is: file name and line number (from 1)
+type location struct {
+	name string
+	line int
+	text string // the line as spelled there, when normalization changed it
+}
+
+// lineStat is everything known about ONE distinct line
+type lineStat struct {
+	count     int
+	perFile   []fileCount // in the order the files were read
+	locations []location  // with -n: the first -max-locations occurrences
+	first     int         // the sequence number of its first appearance among all the lines read
+	firstLine int         // the line number of its first appearance, in perFile[0]
+	spellings []string    // with normalization: the first -spellings distinct original lines
+	more      bool        // and there were more of them
+}
+
+// lineAdder takes the lines of the inputs, one by one, in order
+type lineAdder interface {
+	add(name string, lineNo int, line string)
+}
+
+// dupCounter counts lines across all the inputs
+type dupCounter struct {
+	lines map[string]*lineStat
+	key   func(line string) string // the normalization; nil: lines are counted as they are
+	seq   int                      // the number of lines added
+}
+
+// dup is a reported line: its text and what is known about it
+type dup struct {
+	text string
+	*lineStat
+}
+
+func newDupCounter(key func(line string) string) *dupCounter {
+	return &dupCounter{lines: make(map[string]*lineStat), key: key}
+}
+
+// add counts one occurrence of line, found at line number lineNo of the file called name
+func (c *dupCounter) add(name string, lineNo int, line string) {
+	c.addAt(c.seq, name, lineNo, line)
+	c.seq++
+}
+
+// addAt is add for the line with sequence number seq among all the lines read
+func (c *dupCounter) addAt(seq int, name string, lineNo int, line string) {
+	key := line
+	if c.key != nil {
+		key = c.key(line)
+	}
+	stat := c.lines[key]
+	if stat == nil {
+		stat = &lineStat{first: seq, firstLine: lineNo}
+		c.lines[key] = stat
+	}
+	if c.key != nil {
+		stat.spelled(line)
+	}
+	stat.count++
+	// a file is read from start to end before the next one, so its entry (if any) is the last one
+	if n := len(stat.perFile); n > 0 && stat.perFile[n-1].name == name {
+		stat.perFile[n-1].count++
+	} else {
+		stat.perFile = append(stat.perFile, fileCount{name, 1})
+	}
+	if *withLines && (*maxLocations <= 0 || len(stat.locations) < *maxLocations) {
+		loc := location{name: name, line: lineNo}
+		if line != key {
+			loc.text = line
+		}
+		stat.locations = append(stat.locations, loc)
+	}
+}
+
+// spelled records line as a spelling of the normalized line, unless it is known or there are enough of them
+func (stat *lineStat) spelled(line string) {
+	for _, s := range stat.spellings {
+		if s == line {
+			return
+		}
+	}
+	if len(stat.spellings) < *spellings {
+		stat.spellings = append(stat.spellings, line)
+	} else {
+		stat.more = true
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *mode != "stream" && *mode != "gulp" && *mode != "external" {
+		fmt.Fprintf(os.Stderr, "unknown -mode %q (want stream, gulp or external)\n", *mode)
+		os.Exit(2)
+	}
+	if _, ok := orders[*sortBy]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown -sort %q (want count, text, first or file)\n", *sortBy)
+		os.Exit(2)
+	}
+
+	key, err := normalizer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	filenames := flag.Args()
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+	var dups []dup
+	if *mode == "external" {
+		dups, err = countExternal(filenames, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		counts := newDupCounter(key)
+		for _, filename := range filenames {
+			var err error
+			if *mode == "gulp" {
+				err = gulpLines(filename, counts)
+			} else {
+				err = streamLines(filename, counts)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+		dups = counts.report(*minCount)
+	}
+
+	for _, d := range ranked(dups, *top, orders[*sortBy]) {
+		if !*withLines {
+			fmt.Printf("Found duplicates:【%s】appears【%d】times, in %d file(s): %s;", d.text, d.count, len(d.perFile), d.files())
+			if key != nil {
+				fmt.Printf(" spelled: %s;", d.spelledAs())
+			}
+			fmt.Println()
+			continue
+		}
+		for _, loc := range d.locations {
+			text := d.text
+			if loc.text != "" {
+				text = loc.text
+			}
+			fmt.Printf("%s:%d: %s\n", loc.name, loc.line, text)
+		}
+		if dropped := d.count - len(d.locations); dropped > 0 {
+			fmt.Fprintf(os.Stderr, "dup: %d more location(s) of %q not kept (-max-locations %d)\n", dropped, d.text, *maxLocations)
+		}
+	}
+}
+
+// orders are the -sort orders, as "less" functions
+var orders = map[string]func(a, b dup) bool{
+	"count": func(a, b dup) bool {
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		return a.text < b.text
+	},
+	"text":  func(a, b dup) bool { return a.text < b.text },
+	"first": func(a, b dup) bool { return a.first < b.first },
+	"file": func(a, b dup) bool {
+		if a.perFile[0].name != b.perFile[0].name {
+			return a.perFile[0].name < b.perFile[0].name
+		}
+		if a.firstLine != b.firstLine {
+			return a.firstLine < b.firstLine
+		}
+		return a.first < b.first
+	},
+}
+
+// report returns the lines appearing at least minCount times, in no particular order
+func (c *dupCounter) report(minCount int) []dup {
+	var dups []dup
+	for text, stat := range c.lines {
+		if stat.count >= minCount {
+			dups = append(dups, dup{text, stat})
+		}
+	}
+	return dups
+}
+
+// ranked sorts dups by less, and returns the first top of them (0 = all).
+// The order of map iteration is RANDOM（by intentional design）, hence the sort.
+func ranked(dups []dup, top int, less func(a, b dup) bool) []dup {
+	sort.Slice(dups, func(i, j int) bool { return less(dups[i], dups[j]) })
+	if top > 0 && len(dups) > top {
+		dups = dups[:top]
+	}
+	return dups
+}
+
+// files lists the files of a line with their counts: "a.conf (3), b.conf (2)"
+func (stat *lineStat) files() string {
+	var parts []string
+	for _, f := range stat.perFile {
+		parts = append(parts, fmt.Sprintf("%s (%d)", f.name, f.count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// spelledAs lists the original spellings of a line: "【GET /】【get /】 and more"
+func (stat *lineStat) spelledAs() string {
+	var b strings.Builder
+	for _, s := range stat.spellings {
+		fmt.Fprintf(&b, "【%s】", s)
+	}
+	if stat.more {
+		b.WriteString(" and more")
+	}
+	return b.String()
+}
+
+// streamLines reads a file line by line, as version 2 does; "-" is standard input
+func streamLines(filename string, counts lineAdder) error {
+	file := os.Stdin
+	if filename != "-" {
+		//【os.Open】returns（1）an open file（*os.File）and（2）the built-in error type
+		var err error
+		if file, err = os.Open(filename); err != nil {
+			return err
+		}
+		// close the file and release any related resources
+		defer file.Close()
+	}
+	input := bufio.NewScanner(file)
+	// lines longer than the default 64 KiB are not an error
+	input.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; input.Scan(); lineNo++ {
+		line := input.Text()
+		if filename == "-" && line == "end" {
+			break
+		}
+		counts.add(filename, lineNo, line)
+	}
+	return input.Err()
+}
+
+// gulpLines reads a whole file at once and splits it, as version 3 does; "-" is standard input
+func gulpLines(filename string, counts lineAdder) error {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		//【ioutil.ReadFile】returns（1）a byte slice and（2）the built-in error type
+		data, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return err
+	}
+	// the same lines as bufio.Scanner gives: no empty line after the last newline, no "\r" at the end
+	if len(data) == 0 {
+		return nil
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if filename == "-" && line == "end" {
+			break
+		}
+		counts.add(filename, i+1, line)
+	}
+	return nil
+}
+
+// regexpList collects the repeatable -strip flag
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	var exprs []string
+	for _, re := range *l {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func (l *regexpList) Set(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+// normalizer builds the normalization asked for by the flags, as ONE function; nil when none is
+func normalizer() (func(line string) string, error) {
+	var steps []func(string) string
+	switch *unicodeForm {
+	case "":
+	case "compose":
+		steps = append(steps, compose)
+	case "width":
+		steps = append(steps, func(s string) string { return compose(foldWidth(s)) })
+	default:
+		return nil, fmt.Errorf("unknown -unicode %q (want compose or width)", *unicodeForm)
+	}
+	for _, re := range strips {
+		re := re
+		steps = append(steps, func(s string) string { return re.ReplaceAllString(s, "") })
+	}
+	if *foldCase {
+		steps = append(steps, strings.ToLower)
+	}
+	switch *space {
+	case "":
+	case "trim":
+		steps = append(steps, strings.TrimSpace)
+	case "collapse":
+		//【strings.Fields】splits around runs of whitespace, and drops it at both ends
+		steps = append(steps, func(s string) string { return strings.Join(strings.Fields(s), " ") })
+	default:
+		return nil, fmt.Errorf("unknown -space %q (want trim or collapse)", *space)
+	}
+	if len(steps) == 0 {
+		return nil, nil
+	}
+	return func(line string) string {
+		for _, step := range steps {
+			line = step(line)
+		}
+		return line
+	}, nil
+}
+
+// compositions are the combining marks known to compose, each with pairs of a base and its composed form
+var compositions = map[rune]string{
+	'\u0300': "AÀEÈIÌOÒUÙaàeèiìoòuù",                     // grave
+	'\u0301': "AÁEÉIÍOÓUÚYÝaáeéiíoóuúyýCĆcćNŃnńSŚsśZŹzź", // acute
+	'\u0302': "AÂEÊIÎOÔUÛaâeêiîoôuû",                     // circumflex
+	'\u0303': "AÃNÑOÕaãnñoõ",                             // tilde
+	'\u0308': "AÄEËIÏOÖUÜaäeëiïoöuüyÿ",                   // diaeresis
+	'\u030A': "AÅaåUŮuů",                                 // ring above
+	'\u030C': "CČcčSŠsšZŽzžEĚeěRŘrřNŇnň",                 // caron
+	'\u0327': "CÇcçSŞsş",                                 // cedilla
+	'\u3099': "かがきぎくぐけげこごさざしじすずせぜそぞただちぢつづてでとどはばひびふぶへべほぼうゔ" + // kana voiced sound mark (dakuten)
+		"カガキギクグケゲコゴサザシジスズセゼソゾタダチヂツヅテデトドハバヒビフブヘベホボウヴ",
+	'\u309A': "はぱひぴふぷへぺほぽハパヒピフプヘペホポ", // kana semi-voiced sound mark (handakuten)
+}
+
+// composed maps a base and a combining mark to the composed form, from compositions
+var composed = make(map[[2]rune]rune)
+
+// halfWidth are the half-width katakana forms U+FF61 to U+FF9F, as their full-width equivalents
+const halfWidth = "。「」、・ヲァィゥェォャュョッーアイウエオカキクケコサシスセソタチツテトナニヌネノハヒフヘホマミムメモヤユヨラリルレロワン\u3099\u309A"
+
+func init() {
+	for mark, pairs := range compositions {
+		runes := []rune(pairs)
+		for i := 0; i+1 < len(runes); i += 2 {
+			composed[[2]rune{runes[i], mark}] = runes[i+1]
+		}
+	}
+}
+
+// the Hangul jamo and syllables, as laid out by Unicode (chapter 3.12): a syllable is
+// hangulBase + (leading consonant * vowels + vowel) * trailings + trailing consonant
+const (
+	hangulBase   = 0xAC00 // 가
+	leadingBase  = 0x1100 // ᄀ
+	vowelBase    = 0x1161 // ᅡ
+	trailingBase = 0x11A7 // one before ᆨ: trailing consonant 0 is "none"
+	leadings     = 19
+	vowels       = 21
+	trailings    = 28
+	syllables    = leadings * vowels * trailings
+)
+
+// compose replaces a letter followed by a combining mark with the single composed letter, where one is known,
+// and a Hangul leading consonant + vowel (+ trailing consonant) with their syllable
+func compose(s string) string {
+	var out []rune
+	for _, r := range s {
+		if n := len(out); n > 0 {
+			prev := out[n-1]
+			switch {
+			case prev >= leadingBase && prev < leadingBase+leadings && r >= vowelBase && r < vowelBase+vowels:
+				out[n-1] = hangulBase + ((prev-leadingBase)*vowels+(r-vowelBase))*trailings
+				continue
+			case prev >= hangulBase && prev < hangulBase+syllables && (prev-hangulBase)%trailings == 0 &&
+				r > trailingBase && r < trailingBase+trailings:
+				// a syllable without a trailing consonant takes one
+				out[n-1] = prev + (r - trailingBase)
+				continue
+			case unicode.Is(unicode.Mn, r):
+				if c, ok := composed[[2]rune{prev, r}]; ok {
+					out[n-1] = c
+					continue
+				}
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// foldWidth turns full-width ASCII and the ideographic space into ASCII, and half-width katakana into full-width;
+// the half-width voicing marks become combining marks, for compose
+func foldWidth(s string) string {
+	kana := []rune(halfWidth)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '\uFF01' && r <= '\uFF5E':
+			return r - 0xFEE0
+		case r == '\u3000':
+			return ' '
+		case r >= '\uFF61' && r <= '\uFF9F':
+			return kana[r-0xFF61]
+		}
+		return r
+	}, s)
+}
+
+// countExternal is -mode external: it spills the lines of the files into partitions, then counts them one by one
+func countExternal(filenames []string, key func(line string) string) ([]dup, error) {
+	n := *partitions
+	if n <= 0 {
+		n = partitionsFor(filenames)
+	}
+	if n > maxPartitions {
+		n = maxPartitions
+	}
+	sp, err := newSpiller(*tmpDir, n, key)
+	if err != nil {
+		return nil, err
+	}
+	defer sp.remove()
+	for _, filename := range filenames {
+		if err := streamLines(filename, sp); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+	return sp.count(*minCount, countBudget())
+}
+
+// maxPartitions bounds the partition files written at once, well below the open files allowed to a process
+// (RLIMIT_NOFILE: 1024 on Linux, 256 on macOS); more partitions are made by splitting them again
+const maxPartitions = 128
+
+// stdinPartitions is where standard input, which has no size, starts; its partitions are split again as needed
+const stdinPartitions = 16
+
+// What counting a line takes in memory, measured with runtime.MemStats (64-bit):
+// a distinct line some 200 bytes (map entry, *lineStat, its perFile) besides its text,
+// a location or a spelling some 48 bytes besides the text kept with it.
+const (
+	entryOverhead    = 200
+	locationOverhead = 48
+)
+
+// countBudget is what the lines of ONE partition may take: half of -mem, as the garbage collector
+// lets the heap grow to twice what is live before it collects (GOGC=100)
+func countBudget() int64 {
+	budget := int64(*memBudget) << 20 / 2
+	if budget <= 0 {
+		budget = 1
+	}
+	return budget
+}
+
+// partitionsFor derives the number of partitions from -mem and the size of the files.
+// With entryOverhead, a file of short lines takes several times its size once counted: 8 times is assumed
+// (lines of some 30 bytes); partitions the lines of which take more than that are split again anyway.
+func partitionsFor(filenames []string) int {
+	var size int64
+	for _, filename := range filenames {
+		if filename == "-" {
+			return stdinPartitions
+		}
+		if info, err := os.Stat(filename); err == nil {
+			size += info.Size()
+		}
+	}
+	n := size*8/countBudget() + 1
+	if n > maxPartitions {
+		n = maxPartitions
+	}
+	return int(n)
+}
+
+// maxSplits bounds how many times a partition is split again
+const maxSplits = 4
+
+// partition is ONE partition file, with what counting its lines would take at most
+type partition struct {
+	name     string
+	records  int
+	estimate int64 // bytes: every record taken as a distinct line, with entryOverhead and its texts
+	splits   int   // how many times it was split from a partition of the first spill
+}
+
+// spiller writes the lines into partition files, by the hash of their normalized text, so that
+// all the occurrences of a line are in the same partition. A record is a line with where it was read:
+//
+//	sequence number, file (an index in names), line number, length: uvarints; then the line itself
+type spiller struct {
+	dir   string
+	key   func(line string) string
+	files []*os.File
+	parts []*bufio.Writer // buffering files
+	sizes []partition     // what is written in each of them
+	names []string        // the input file names, in the order they were read
+	seq   int             // the number of lines spilled
+	rec   []byte          // reused for each record
+	err   error           // the first write error; the following lines are dropped
+}
+
+func newSpiller(tmpDir string, partitions int, key func(line string) string) (*spiller, error) {
+	dir, err := os.MkdirTemp(tmpDir, "dup-")
+	if err != nil {
+		return nil, err
+	}
+	sp := &spiller{dir: dir, key: key}
+	if err := sp.create(dir+"/part-", partitions); err != nil {
+		sp.remove()
+		return nil, err
+	}
+	return sp, nil
+}
+
+// create opens n partition files to write, named by prefix and their index
+func (sp *spiller) create(prefix string, n int) error {
+	sp.files, sp.parts, sp.sizes = nil, nil, nil
+	for i := 0; i < n; i++ {
+		f, err := os.Create(fmt.Sprintf("%s%04d", prefix, i))
+		if err != nil {
+			sp.close()
+			return err
+		}
+		sp.files = append(sp.files, f)
+		sp.parts = append(sp.parts, bufio.NewWriterSize(f, 32*1024))
+		sp.sizes = append(sp.sizes, partition{name: f.Name()})
+	}
+	return nil
+}
+
+// add spills one line; the same file name twice in a row is the same file, as it is for dupCounter
+func (sp *spiller) add(name string, lineNo int, line string) {
+	if sp.err != nil {
+		return
+	}
+	if n := len(sp.names); n == 0 || sp.names[n-1] != name {
+		sp.names = append(sp.names, name)
+	}
+	sp.write(0, sp.seq, len(sp.names)-1, lineNo, line)
+	sp.seq++
+}
+
+// write writes one record into the partition files being written, hashed with seed:
+// a partition split again is split by another hash than the one that put its lines together
+func (sp *spiller) write(seed byte, seq, file, lineNo int, line string) {
+	key := line
+	if sp.key != nil {
+		key = sp.key(line)
+	}
+	h := fnv.New64a()
+	if seed > 0 {
+		h.Write([]byte{seed})
+	}
+	io.WriteString(h, key)
+	i := h.Sum64() % uint64(len(sp.parts))
+
+	rec := binary.AppendUvarint(sp.rec[:0], uint64(seq))
+	rec = binary.AppendUvarint(rec, uint64(file))
+	rec = binary.AppendUvarint(rec, uint64(lineNo))
+	rec = binary.AppendUvarint(rec, uint64(len(line)))
+	rec = append(rec, line...)
+	_, sp.err = sp.parts[i].Write(rec)
+	sp.rec = rec
+
+	// what dupCounter.addAt keeps of it, were it a distinct line
+	size := int64(entryOverhead + len(key))
+	if key != line {
+		size += locationOverhead + int64(len(line)) // a spelling
+	}
+	if *withLines {
+		size += locationOverhead
+		if key != line {
+			size += int64(len(line))
+		}
+	}
+	sp.sizes[i].records++
+	sp.sizes[i].estimate += size
+}
+
+// close flushes and closes the partition files being written
+func (sp *spiller) close() error {
+	err := sp.err
+	for i, f := range sp.files {
+		if e := sp.parts[i].Flush(); err == nil {
+			err = e
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	sp.files, sp.parts = nil, nil
+	return err
+}
+
+// count counts the partitions one at a time, each with a dupCounter of its own, and returns the lines reported.
+// A line is in ONE partition only, and its records are in the order they were read, so its count, files, locations
+// and first appearance are the same as when all the lines are counted at once.
+// A partition whose lines may take more than budget is split again first; its estimate counts every record as a
+// distinct line, so a partition of few lines read many times may not split: it is counted as it is.
+func (sp *spiller) count(minCount int, budget int64) ([]dup, error) {
+	if err := sp.close(); err != nil {
+		return nil, err
+	}
+	queue := sp.sizes
+	var dups []dup
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if p.estimate > budget && p.records > 1 && p.splits < maxSplits {
+			parts, err := sp.split(p, budget)
+			if err != nil {
+				return nil, err
+			}
+			if len(parts) > 1 {
+				queue = append(queue, parts...)
+				continue
+			}
+			p = parts[0] // all its lines hash the same again: nothing to gain
+		}
+		f, err := os.Open(p.name)
+		if err != nil {
+			return nil, err
+		}
+		counts := newDupCounter(sp.key)
+		err = sp.replay(bufio.NewReader(f), func(seq, file, lineNo int, line []byte) {
+			counts.addAt(seq, sp.names[file], lineNo, string(line))
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.name, err)
+		}
+		dups = append(dups, counts.report(minCount)...)
+		// done with it: give back the disk space now
+		os.Remove(p.name)
+	}
+	return dups, nil
+}
+
+// split writes the records of partition p into as many new partitions as its estimate needs to fit budget,
+// and returns those that are not empty
+func (sp *spiller) split(p partition, budget int64) ([]partition, error) {
+	n := p.estimate/budget + 1
+	if n > maxPartitions {
+		n = maxPartitions
+	}
+	if err := sp.create(p.name+".", int(n)); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p.name)
+	if err != nil {
+		sp.close()
+		return nil, err
+	}
+	seed := byte(p.splits + 1)
+	err = sp.replay(bufio.NewReader(f), func(seq, file, lineNo int, line []byte) {
+		if sp.err == nil {
+			sp.write(seed, seq, file, lineNo, string(line))
+		}
+	})
+	f.Close()
+	if e := sp.close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.name, err)
+	}
+	os.Remove(p.name)
+
+	var parts []partition
+	for _, part := range sp.sizes {
+		if part.records == 0 {
+			os.Remove(part.name)
+			continue
+		}
+		part.splits = p.splits + 1
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// replay reads the records of a partition, and gives each of them to do
+func (sp *spiller) replay(r *bufio.Reader, do func(seq, file, lineNo int, line []byte)) error {
+	var line []byte
+	for {
+		var fields [4]uint64
+		for i := range fields {
+			v, err := binary.ReadUvarint(r)
+			if err == io.EOF && i == 0 {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("bad record: %v", err)
+			}
+			fields[i] = v
+		}
+		seq, file, lineNo, length := fields[0], fields[1], fields[2], fields[3]
+		if file >= uint64(len(sp.names)) {
+			return fmt.Errorf("bad record: file %d", file)
+		}
+		if uint64(cap(line)) < length {
+			line = make([]byte, length)
+		}
+		line = line[:length]
+		if _, err := io.ReadFull(r, line); err != nil {
+			return fmt.Errorf("bad record: %v", err)
+		}
+		do(int(seq), int(file), int(lineNo), line)
+	}
+}
+
+// remove deletes the partition files and their directory
+func (sp *spiller) remove() {
+	sp.close()
+	os.RemoveAll(sp.dir)
+}
@@ -0,0 +1,184 @@
+/*
+	Tests of 1_find_duplicate_lines_4.go: -mode external against the in-memory count, and the -unicode forms.
+
+	go test 1_find_duplicate_lines_4.go 1_find_duplicate_lines_4_test.go
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"e\u0301", "\u00E9"}, // é
+		{"Cafe\u0301 cre\u0300me", "Caf\u00E9 cr\u00E8me"},
+		{"か\u3099", "が"},
+		{"ハ\u309A", "パ"},
+		{"\u1112\u1161\u11AB", "한"},
+		{"\u1100\u1161", "가"},
+		{"가\u11A8", "각"},
+		{"각\u11A8", "각\u11A8"},            // a syllable takes ONE trailing consonant
+		{"a\u0301\u0301", "\u00E1\u0301"}, // only the first mark composes
+		{"x\u0301", "x\u0301"},            // no such letter
+		{"\u0301e", "\u0301e"},            // a mark before its letter
+		{"한국어 \u00E9", "한국어 \u00E9"},      // already composed
+		{"\u11AB\u1161", "\u11AB\u1161"},  // a trailing consonant, then a vowel: no syllable
+	} {
+		if got := compose(test.in); got != test.want {
+			t.Errorf("compose(%+q) = %+q, want %+q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFoldWidth(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"ＡＢＣ１２３", "ABC123"},
+		{"！～", "!~"},
+		{"a\u3000b", "a b"},
+		{"ｶﾀｶﾅ", "カタカナ"},
+		{"｡｢｣､･", "。「」、・"},
+		{"ｶﾞ", "カ\u3099"}, // the half-width voicing mark becomes a combining one, for compose
+		{"ﾊﾟ", "ハ\u309A"},
+		{"abc ひらがな 漢字", "abc ひらがな 漢字"},
+	} {
+		if got := foldWidth(test.in); got != test.want {
+			t.Errorf("foldWidth(%+q) = %+q, want %+q", test.in, got, test.want)
+		}
+	}
+	if got := compose(foldWidth("ｶﾞｷﾞ ＡＢ")); got != "ガギ AB" {
+		t.Errorf(`-unicode width of "ｶﾞｷﾞ ＡＢ" = %+q, want "ガギ AB"`, got)
+	}
+}
+
+// dupInput writes two files of lines that repeat, within a file and across both, spelled in several ways
+func dupInput(t *testing.T) []string {
+	words := []string{"GET /a", "get /A", "  x  y ", "x y", "H\u00E9llo", "He\u0301llo", "ｶﾞ", "ガ",
+		"foo 12:00:01", "foo 12:00:02", ""}
+	for i := 0; i < 3000; i++ {
+		words = append(words, fmt.Sprintf("line %d", i))
+	}
+	random := rand.New(rand.NewSource(1))
+	var filenames []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		var b strings.Builder
+		for i := 0; i < 20000; i++ {
+			b.WriteString(words[random.Intn(len(words))])
+			b.WriteByte('\n')
+		}
+		filename := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(filename, []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames
+}
+
+// render prints everything reported about dups, in a fixed order
+func render(dups []dup) string {
+	var b strings.Builder
+	for _, d := range ranked(dups, 0, orders["first"]) {
+		fmt.Fprintf(&b, "%q %d, first %d (line %d) in %s; %s %v\n",
+			d.text, d.count, d.first, d.firstLine, d.files(), d.spelledAs(), d.locations)
+	}
+	return b.String()
+}
+
+// countStream is -mode stream, as main runs it
+func countStream(t *testing.T, filenames []string, key func(line string) string) []dup {
+	counts := newDupCounter(key)
+	for _, filename := range filenames {
+		if err := streamLines(filename, counts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return counts.report(*minCount)
+}
+
+// TestExternal checks that -mode external reports what -mode stream does, with partitions split again
+// as -mem (its least, 1 MiB) requires, for some of the flags that change what is kept about a line
+func TestExternal(t *testing.T) {
+	filenames := dupInput(t)
+	defer func(n bool, locations, spelled int, fold bool, sp, form string, mem, parts int, dir string) {
+		*withLines, *maxLocations, *spellings, *foldCase, *space, *unicodeForm = n, locations, spelled, fold, sp, form
+		*memBudget, *partitions, *tmpDir = mem, parts, dir
+		strips = nil
+	}(*withLines, *maxLocations, *spellings, *foldCase, *space, *unicodeForm, *memBudget, *partitions, *tmpDir)
+	*memBudget, *tmpDir = 1, t.TempDir()
+
+	for _, test := range []struct {
+		name  string
+		flags func()
+	}{
+		{"plain", func() {}},
+		{"-n", func() { *withLines = true }},
+		{"-i -space collapse", func() { *foldCase, *space = true, "collapse" }},
+		{"-unicode width -strip -n -max-locations 3", func() {
+			*unicodeForm, *withLines, *maxLocations = "width", true, 3
+			strips = regexpList{regexp.MustCompile(`[0-9:]+`)}
+		}},
+		{"-i -spellings 1", func() { *foldCase, *spellings = true, 1 }},
+	} {
+		*withLines, *maxLocations, *spellings, *foldCase, *space, *unicodeForm = false, 0, 3, false, "", ""
+		strips = nil
+		test.flags()
+		key, err := normalizer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := render(countStream(t, filenames, key))
+		for _, n := range []int{0, 1, 3, 1000} {
+			*partitions = n
+			dups, err := countExternal(filenames, key)
+			if err != nil {
+				t.Fatalf("%s, -partitions %d: %v", test.name, n, err)
+			}
+			if got := render(dups); got != want {
+				t.Errorf("%s, -partitions %d: external differs from stream", test.name, n)
+			}
+		}
+	}
+}
+
+// TestSplit counts ONE partition with a budget that takes several splits, down to maxSplits
+func TestSplit(t *testing.T) {
+	filenames := dupInput(t)
+	want := render(countStream(t, filenames, nil))
+
+	sp, err := newSpiller(t.TempDir(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.remove()
+	for _, filename := range filenames {
+		if err := streamLines(filename, sp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const budget = 4096
+	if estimate := sp.sizes[0].estimate; estimate < 100*budget {
+		t.Fatalf("estimate %d: want far more than the budget %d, to split again", estimate, budget)
+	}
+	dups, err := sp.count(*minCount, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := render(dups); got != want {
+		t.Errorf("split partitions differ from stream")
+	}
+	if left, _ := filepath.Glob(filepath.Join(sp.dir, "*")); len(left) > 0 {
+		t.Errorf("partition files left behind: %v", left)
+	}
+}